@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// avatarTimeout keeps a slow Gravatar from holding up notifications
+	avatarTimeout = 5 * time.Second
+
+	// avatarMissTTL is how long a sender without a Gravatar isn't looked up again
+	avatarMissTTL = 7 * 24 * time.Hour
+)
+
+// avatarDir returns where downloaded avatars are cached
+func avatarDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(stateDir(), "avatars")
+	}
+	return filepath.Join(dir, "gmail-notifications", "avatars")
+}
+
+// senderIcon returns the path of the sender's cached Gravatar with -gravatar,
+// downloading it on first use. Empty when disabled or the sender has none,
+// so the notifier falls back to -icon
+func senderIcon(sender string) string {
+	if !gravatar || !strings.Contains(sender, "@") {
+		return ""
+	}
+
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(sender))))
+	hash := hex.EncodeToString(sum[:])
+	path := filepath.Join(avatarDir(), hash+".png")
+
+	// An empty file records a sender without a Gravatar
+	if info, err := os.Stat(path); err == nil {
+		if info.Size() > 0 {
+			return path
+		}
+		if time.Since(info.ModTime()) < avatarMissTTL {
+			return ""
+		}
+	}
+
+	data, err := fetchGravatar(hash)
+	if err != nil {
+		slog.Debug("gravatar lookup failed", "from", sender, "err", err)
+		return ""
+	}
+	os.MkdirAll(avatarDir(), 0700)
+	if err := os.WriteFile(path, data, 0600); err != nil || len(data) == 0 {
+		return ""
+	}
+	return path
+}
+
+// fetchGravatar downloads a 128px avatar, returning no data if there is none
+func fetchGravatar(hash string) ([]byte, error) {
+	client := &http.Client{Timeout: avatarTimeout}
+	resp, err := client.Get("https://www.gravatar.com/avatar/" + hash + "?s=128&d=404")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset" // transcode ISO-8859-*, windows-125x, etc. to UTF-8
+	"github.com/emersion/go-message/mail"
+)
+
+var urlRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+var (
+	htmlHiddenRegex = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>`)
+	htmlBreakRegex  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6])\b[^>]*>`)
+	htmlTagRegex    = regexp.MustCompile(`<[^>]*>`)
+	blankLinesRegex = regexp.MustCompile(`\n\s*\n\s*`)
+	spacesRegex     = regexp.MustCompile(`[ \t\r\f]+`)
+
+	trailingSpaceRegex = regexp.MustCompile(`[ \t\f]+\n`)
+	extraLinesRegex    = regexp.MustCompile(`\n{3,}`)
+
+	// Reply headers like "On Mon, 1 Jan 2024 at 10:00, Bob <bob@x.com> wrote:",
+	// which mail clients often wrap onto two lines
+	replyHeaderRegex = regexp.MustCompile(`(?m)^On [^\n]+(\n[^\n]*)?wrote:\s*$`)
+	quoteRegex       = regexp.MustCompile(`(?m)^[ \t]*>.*$\n?`)
+)
+
+// messageText walks the MIME parts of a raw message and returns its body
+// text, picking the part by -body-prefer, and its attachment names
+// Transfer encodings and charsets are decoded to UTF-8 by the part reader
+// NextPart descends into nested multiparts, so text in multipart/related or
+// multipart/alternative inside multipart/mixed is found at any depth
+func messageText(r io.Reader) (string, []string) {
+	bodyText, htmlText, firstText := "", "", ""
+	var attachments []string
+
+	// An unknown charset error still comes with a readable reader/part
+	mr, err := mail.CreateReader(r)
+	if err == nil || message.IsUnknownCharset(err) {
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil && !message.IsUnknownCharset(err) {
+				break
+			}
+			switch h := p.Header.(type) {
+			case *mail.InlineHeader:
+				contentType, _, _ := h.ContentType()
+				// The first part of each type is usually the message, later
+				// ones are footers added by lists. Keep walking for attachments
+				switch contentType {
+				case "text/plain":
+					b, _ := io.ReadAll(p.Body)
+					bodyText = cmp.Or(bodyText, string(b))
+					firstText = cmp.Or(firstText, bodyText)
+				case "text/html":
+					b, _ := io.ReadAll(p.Body)
+					htmlText = cmp.Or(htmlText, htmlToText(string(b)))
+					firstText = cmp.Or(firstText, htmlText)
+				}
+			case *mail.AttachmentHeader:
+				name, _ := h.Filename()
+				attachments = append(attachments, name)
+			}
+		}
+	}
+
+	switch bodyPrefer {
+	case "html":
+		bodyText = cmp.Or(htmlText, bodyText)
+	case "first":
+		bodyText = firstText
+	default:
+		// Prefer text/plain, fall back to stripped HTML
+		bodyText = cmp.Or(bodyText, htmlText)
+	}
+
+	// Bodies in an unknown charset are kept as raw bytes, which may not be UTF-8
+	return strings.ToValidUTF8(bodyText, "\uFFFD"), attachments
+}
+
+// formatBody cleans up text from messageText for display, truncated to
+// maxLen. Attachments are listed on a line after the body
+func formatBody(bodyText string, attachments []string, maxLen int) string {
+	if stripQuotes {
+		bodyText = removeQuoted(bodyText)
+	}
+
+	// Normalize before truncating so whitespace doesn't eat into maxLen
+	bodyText = normalizeWhitespace(bodyText)
+	if bodyFirstLine {
+		// Leading blank lines are already trimmed
+		bodyText, _, _ = strings.Cut(bodyText, "\n")
+		return truncateBody(bodyText, maxLen)
+	}
+	bodyText = truncateBody(bodyText, maxLen)
+	if len(attachments) > 0 {
+		bodyText = strings.TrimSpace(bodyText + "\n\n" + attachmentSummary(attachments))
+	}
+	return bodyText
+}
+
+// makeSnippet returns text from messageText as a single line of at most
+// maxLen characters, without the quoted thread, for -snippet-length
+func makeSnippet(text string, maxLen int) string {
+	text = strings.Join(strings.Fields(removeQuoted(text)), " ")
+	return truncateBody(text, maxLen)
+}
+
+// parseEnvelope builds the IMAP envelope fields used for notifications from
+// a raw message's headers, for sources other than IMAP
+func parseEnvelope(raw []byte) *imap.Envelope {
+	env := &imap.Envelope{}
+	e, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return env
+	}
+
+	// Kept with their angle brackets, like IMAP envelopes
+	h := mail.Header{Header: e.Header}
+	env.Subject, _ = h.Subject()
+	env.Date, _ = h.Date()
+	env.MessageId = strings.TrimSpace(h.Get("Message-Id"))
+	env.InReplyTo = strings.TrimSpace(h.Get("In-Reply-To"))
+	if from, err := h.AddressList("From"); err == nil && len(from) > 0 {
+		env.From = imapAddresses(from[:1])
+	}
+	if to, err := h.AddressList("To"); err == nil {
+		env.To = imapAddresses(to)
+	}
+	if cc, err := h.AddressList("Cc"); err == nil {
+		env.Cc = imapAddresses(cc)
+	}
+	return env
+}
+
+// imapAddresses converts parsed header addresses to envelope addresses
+func imapAddresses(list []*mail.Address) []*imap.Address {
+	var addrs []*imap.Address
+	for _, a := range list {
+		mailbox, host, _ := strings.Cut(a.Address, "@")
+		addrs = append(addrs, &imap.Address{PersonalName: a.Name, MailboxName: mailbox, HostName: host})
+	}
+	return addrs
+}
+
+// attachmentSummary formats a line like "📎 2 attachments: report.pdf, photo.jpg"
+func attachmentSummary(names []string) string {
+	summary := "📎 1 attachment"
+	if len(names) > 1 {
+		summary = fmt.Sprintf("📎 %d attachments", len(names))
+	}
+
+	var named []string
+	for _, name := range names {
+		if name != "" {
+			named = append(named, name)
+		}
+	}
+	if len(named) > 0 {
+		summary += ": " + strings.Join(named, ", ")
+	}
+	return summary
+}
+
+// truncateBody truncates text to maxLen characters without cutting URLs
+// If cutting would split a URL, cuts before the URL instead
+func truncateBody(text string, maxLen int) string {
+	if utf8.RuneCountInString(text) <= maxLen {
+		return text
+	}
+
+	// No room for "...", hard cut instead
+	if maxLen <= 3 {
+		return text[:runeOffset(text, max(maxLen, 0))]
+	}
+
+	// Find all URLs and their byte positions
+	urls := urlRegex.FindAllStringIndex(text, -1)
+
+	// Find safe cut point, as a byte offset on a character boundary
+	cutPoint := runeOffset(text, maxLen-3) // leave room for "..."
+
+	for _, url := range urls {
+		urlStart, urlEnd := url[0], url[1]
+
+		// If cut point is inside a URL, move it before the URL
+		if cutPoint > urlStart && cutPoint < urlEnd {
+			cutPoint = urlStart
+			break
+		}
+	}
+
+	// If cut point is 0 or negative (URL at start is too long), skip body
+	if cutPoint <= 0 {
+		return ""
+	}
+
+	return text[:cutPoint] + "..."
+}
+
+// runeOffset returns the byte offset of the nth character of s, or len(s)
+// if s is shorter
+func runeOffset(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
+
+// removeQuoted drops the quoted thread below a reply: everything from an
+// "On ... wrote:" or "-----Original Message-----" line on, and any > lines
+func removeQuoted(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if loc := replyHeaderRegex.FindStringIndex(text); loc != nil {
+		text = text[:loc[0]]
+	}
+	if i := strings.Index(text, "-----Original Message-----"); i >= 0 {
+		text = text[:i]
+	}
+	return quoteRegex.ReplaceAllString(text, "")
+}
+
+// normalizeWhitespace converts CRLF to LF, drops trailing spaces, collapses
+// runs of blank lines into one and trims the text
+func normalizeWhitespace(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = trailingSpaceRegex.ReplaceAllString(text+"\n", "\n")
+	text = extraLinesRegex.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// htmlToText strips tags from an HTML body to produce readable plain text
+func htmlToText(body string) string {
+	text := htmlHiddenRegex.ReplaceAllString(body, "")
+	text = htmlBreakRegex.ReplaceAllString(text, "\n")
+	text = htmlTagRegex.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = spacesRegex.ReplaceAllString(text, " ")
+	text = blankLinesRegex.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
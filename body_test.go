@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTruncateBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		maxLen int
+		want   string
+	}{
+		{"short", "Hello", 10, "Hello"},
+		{"exactly at limit", "0123456789", 10, "0123456789"},
+		{"over limit", "0123456789ab", 10, "0123456..."},
+		{"empty", "", 10, ""},
+		{"maxLen 3", "Hello", 3, "Hel"},
+		{"maxLen under 3", "Hello", 2, "He"},
+		{"maxLen 0", "Hello", 0, ""},
+		{"negative maxLen", "Hello", -1, ""},
+		{"multibyte", "héllo wörld", 8, "héllo..."},
+		{"cut inside URL", "See https://example.com/a/long/path", 15, "See ..."},
+		{"URL at start", "https://example.com/a/long/path", 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateBody(tt.text, tt.maxLen); got != tt.want {
+				t.Errorf("truncateBody(%q, %d) = %q, want %q", tt.text, tt.maxLen, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageTextDecodesTransferEncodings(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "quoted-printable",
+			raw: "Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Caf=C3=A9 at 10=3D30, see you=20\r\n" +
+				"there. This line is wrapped with a soft line br=\r\n" +
+				"eak.\r\n",
+			want: "Café at 10=30, see you \r\nthere. This line is wrapped with a soft line break.\r\n",
+		},
+		{
+			name: "quoted-printable latin-1",
+			raw: "Content-Type: text/plain; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Gr=FC=DFe\r\n",
+			want: "Grüße\r\n",
+		},
+		{
+			name: "base64 in multipart",
+			raw: "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"SGVsbG8sIHfDtnJsZCE=\r\n" +
+				"--b--\r\n",
+			want: "Hello, wörld!",
+		},
+		{
+			name: "alternative in related in mixed",
+			raw: "Content-Type: multipart/mixed; boundary=m\r\n\r\n" +
+				"--m\r\n" +
+				"Content-Type: multipart/related; boundary=r\r\n\r\n" +
+				"--r\r\n" +
+				"Content-Type: multipart/alternative; boundary=a\r\n\r\n" +
+				"--a\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Caf=C3=A9 at noon\r\n" +
+				"--a\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+				"<p>Caf&eacute; at noon</p>\r\n" +
+				"--a--\r\n" +
+				"--r\r\n" +
+				"Content-Type: image/png\r\n" +
+				"Content-Disposition: inline\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"iVBORw0KGgo=\r\n" +
+				"--r--\r\n" +
+				"--m\r\n" +
+				"Content-Type: application/pdf\r\n" +
+				"Content-Disposition: attachment; filename=menu.pdf\r\n\r\n" +
+				"%PDF\r\n" +
+				"--m--\r\n",
+			want: "Café at noon",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := messageText(strings.NewReader(tt.raw))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatBodyNormalizesWhitespace(t *testing.T) {
+	// CRLF line ends, trailing spaces and tabs, runs of blank lines and a
+	// signature pushed down by whitespace, in the text/plain part of a
+	// multipart/alternative message
+	raw := "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"\r\n\r\n   \r\n" +
+		"Hi Bob,  \r\n" +
+		"\r\n\r\n\r\n\r\n" +
+		"The report is attached.\t\r\n" +
+		"\r\n \r\n\t\r\n" +
+		"-- \r\n" +
+		"Alice   \r\n" +
+		"\r\n\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p>Hi Bob,</p>\r\n" +
+		"--b--\r\n"
+
+	text, attachments := messageText(strings.NewReader(raw))
+	got := formatBody(text, attachments, 500)
+	want := "Hi Bob,\n\nThe report is attached.\n\n--\nAlice"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Whitespace doesn't count towards the length
+	if got := formatBody(text, attachments, 20); got != "Hi Bob,\n\nThe repo..." {
+		t.Errorf("truncated to 20 got %q", got)
+	}
+}
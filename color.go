@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ANSI styles for the stdout printer
+const (
+	ansiCyan  = "36"
+	ansiBold  = "1"
+	ansiGray  = "90"
+	ansiReset = "\033[0m"
+)
+
+// useColor is set from -color once flags are parsed
+var useColor bool
+
+// colorEnabled resolves -color: auto colors only when stdout is a terminal
+// and NO_COLOR (https://no-color.org) isn't set
+func colorEnabled(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		info, err := os.Stdout.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, fmt.Errorf("unknown color mode %q, use auto, always or never", mode)
+	}
+}
+
+// paint wraps s in an ANSI style when coloring is enabled
+func paint(style, s string) string {
+	if !useColor || s == "" {
+		return s
+	}
+	return "\033[" + style + "m" + s + ansiReset
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"compress/flate"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// deflateConn is a connection that can switch to COMPRESS=DEFLATE (RFC 4978)
+// mid-stream. It sits between go-imap and TLS, so switching doesn't need
+// go-imap's connection upgrade, which extensions can't drive safely
+type deflateConn struct {
+	net.Conn
+
+	mu sync.Mutex
+	r  io.Reader
+	w  *flate.Writer
+
+	// early holds compressed bytes a Read already waiting when compression
+	// was enabled got from the connection
+	early []byte
+}
+
+// dialDeflate dials addr over TLS like client.DialWithDialerTLS, with a
+// deflateConn on top for -compress
+func dialDeflate(addr string) (*client.Client, *deflateConn, error) {
+	conn, err := imapDialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// tlsConfig always names -imap-host
+	dc := &deflateConn{Conn: tls.Client(conn, tlsConfig)}
+	c, err := client.New(dc)
+	if err != nil {
+		dc.Close()
+		return nil, nil, err
+	}
+	return c, dc, nil
+}
+
+// enable switches both directions to DEFLATE, once the server accepted it
+func (dc *deflateConn) enable() error {
+	w, err := flate.NewWriter(dc.Conn, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.w = w
+	dc.r = flate.NewReader(deflateSource{dc})
+	return nil
+}
+
+func (dc *deflateConn) Read(p []byte) (int, error) {
+	dc.mu.Lock()
+	r := dc.r
+	dc.mu.Unlock()
+	if r != nil {
+		return r.Read(p)
+	}
+
+	n, err := dc.Conn.Read(p)
+	dc.mu.Lock()
+	r = dc.r
+	if r != nil && n > 0 {
+		// The server only compresses after accepting COMPRESS, so anything read
+		// once compression is on belongs to the compressed stream
+		dc.early = append(dc.early, p[:n]...)
+	}
+	dc.mu.Unlock()
+	if r != nil {
+		return r.Read(p)
+	}
+	return n, err
+}
+
+func (dc *deflateConn) Write(p []byte) (int, error) {
+	dc.mu.Lock()
+	w := dc.w
+	dc.mu.Unlock()
+	if w == nil {
+		return dc.Conn.Write(p)
+	}
+
+	// go-imap flushes once per command, flush the compressor along with it
+	n, err := w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Flush()
+}
+
+// deflateSource feeds the decompressor any early bytes, then the connection
+type deflateSource struct {
+	dc *deflateConn
+}
+
+func (s deflateSource) Read(p []byte) (int, error) {
+	s.dc.mu.Lock()
+	if len(s.dc.early) > 0 {
+		n := copy(p, s.dc.early)
+		s.dc.early = s.dc.early[n:]
+		s.dc.mu.Unlock()
+		return n, nil
+	}
+	s.dc.mu.Unlock()
+	return s.dc.Conn.Read(p)
+}
+
+// compressCmd is the COMPRESS command
+type compressCmd struct{}
+
+func (compressCmd) Command() *imap.Command {
+	return &imap.Command{Name: "COMPRESS", Arguments: []interface{}{imap.RawString("DEFLATE")}}
+}
+
+// startCompression negotiates COMPRESS=DEFLATE after login, carrying on
+// uncompressed when the server doesn't offer it or refuses
+func startCompression(c *client.Client, dc *deflateConn, user string) {
+	if ok, err := c.Support("COMPRESS=DEFLATE"); err != nil || !ok {
+		slog.Debug("server doesn't support COMPRESS=DEFLATE, continuing uncompressed", "account", user)
+		return
+	}
+
+	status, err := c.Execute(compressCmd{}, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err == nil {
+		err = dc.enable()
+	}
+	if err != nil {
+		slog.Warn("enabling compression failed, continuing uncompressed", "account", user, "err", err)
+		return
+	}
+	slog.Debug("compression enabled", "account", user)
+}
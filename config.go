@@ -0,0 +1,305 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// fileConfig is the -config TOML file, flags and env vars override its values
+type fileConfig struct {
+	User               string         `toml:"user"`
+	Password           string         `toml:"password"`
+	PasswordFile       *string        `toml:"password_file"`
+	OAuthToken         string         `toml:"oauth_token"`
+	Interval           *time.Duration `toml:"interval"`
+	Mailbox            *string        `toml:"mailbox"`
+	IMAPHost           *string        `toml:"imap_host"`
+	IMAPPort           *int           `toml:"imap_port"`
+	Protocol           *string        `toml:"protocol"`
+	PubSubTopic        *string        `toml:"pubsub_topic"`
+	PubSubSubscription *string        `toml:"pubsub_subscription"`
+	StartTLS           *bool          `toml:"starttls"`
+	Compress           *bool          `toml:"compress"`
+	CACert             *string        `toml:"ca_cert"`
+	Proxy              *string        `toml:"proxy"`
+	Timeout            *time.Duration `toml:"timeout"`
+	Length             *int           `toml:"length"`
+	SnippetLength      *int           `toml:"snippet_length"`
+	ShowTo             *bool          `toml:"show_to"`
+	ShowCc             *bool          `toml:"show_cc"`
+	StripQuotes        *bool          `toml:"strip_quotes"`
+	BodyPrefer         *string        `toml:"body_prefer"`
+	BodyFirstLine      *bool          `toml:"body_first_line"`
+	HeadersOnly        *bool          `toml:"headers_only"`
+	Color              *string        `toml:"color"`
+	FromAllow          *string        `toml:"from_allow"`
+	FromBlock          *string        `toml:"from_block"`
+	SubjectFilter      *string        `toml:"subject_filter"`
+	IgnoreAutomated    *bool          `toml:"ignore_automated"`
+	AutomatedPattern   *string        `toml:"automated_pattern"`
+	UrgentFrom         *string        `toml:"urgent_from"`
+	UrgentSubject      *string        `toml:"urgent_subject"`
+	NotifyTimeout      *time.Duration `toml:"notify_timeout"`
+	Sound              *string        `toml:"sound"`
+	SummaryTemplate    *string        `toml:"summary_template"`
+	BodyTemplate       *string        `toml:"body_template"`
+	Icon               *string        `toml:"icon"`
+	Gravatar           *bool          `toml:"gravatar"`
+	UnreadSummary      *bool          `toml:"unread_summary"`
+	MarkRead           *bool          `toml:"mark_read"`
+	OnlyFlagged        *bool          `toml:"only_flagged"`
+	Category           *string        `toml:"category"`
+	GMLabel            *string        `toml:"gm_label"`
+	ShowLabels         *bool          `toml:"show_labels"`
+	Since              *string        `toml:"since"`
+	ScanDepth          *int           `toml:"scan_depth"`
+	HistoryFile        *string        `toml:"history_file"`
+	Webhook            *string        `toml:"webhook"`
+	SlackWebhook       *string        `toml:"slack_webhook"`
+	DiscordWebhook     *string        `toml:"discord_webhook"`
+	Exec               *string        `toml:"exec"`
+	Coalesce           *int           `toml:"coalesce"`
+	MaxPerMinute       *int           `toml:"max_per_minute"`
+	Digest             *time.Duration `toml:"digest"`
+	NotifyWhen         *string        `toml:"notify_when"`
+	QuietStart         *string        `toml:"quiet_start"`
+	QuietEnd           *string        `toml:"quiet_end"`
+	LogLevel           *string        `toml:"log_level"`
+	MetricsAddr        *string        `toml:"metrics_addr"`
+	Socket             *string        `toml:"socket"`
+}
+
+// loadConfig reads a TOML config file
+func loadConfig(path string) (*fileConfig, error) {
+	var cfg fileConfig
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// apply sets every option present in the file that wasn't given as a flag
+func (cfg *fileConfig) apply() {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	cfg.applyRules(set)
+	if cfg.PasswordFile != nil && !set["password-file"] && !set["password-stdin"] {
+		passwordFile = *cfg.PasswordFile
+	}
+	if cfg.Mailbox != nil && !set["m"] && !set["mailbox"] {
+		mailbox = *cfg.Mailbox
+	}
+	if cfg.IMAPHost != nil && !set["imap-host"] {
+		imapHost = *cfg.IMAPHost
+	}
+	if cfg.IMAPPort != nil && !set["imap-port"] {
+		imapPort = *cfg.IMAPPort
+	}
+	if cfg.Protocol != nil && !set["protocol"] && !set["backend"] {
+		protocol = *cfg.Protocol
+	}
+	if cfg.PubSubTopic != nil && !set["pubsub-topic"] {
+		pubsubTopic = *cfg.PubSubTopic
+	}
+	if cfg.PubSubSubscription != nil && !set["pubsub-subscription"] {
+		pubsubSubscription = *cfg.PubSubSubscription
+	}
+	if cfg.StartTLS != nil && !set["starttls"] {
+		startTLS = *cfg.StartTLS
+	}
+	if cfg.Compress != nil && !set["compress"] {
+		compress = *cfg.Compress
+	}
+	if cfg.CACert != nil && !set["ca-cert"] {
+		caCert = *cfg.CACert
+	}
+	if cfg.Proxy != nil && !set["proxy"] {
+		proxyURL = *cfg.Proxy
+	}
+	if cfg.Timeout != nil && !set["timeout"] {
+		timeout = *cfg.Timeout
+	}
+	if cfg.Length != nil && !set["l"] && !set["length"] {
+		msgLenght = *cfg.Length
+	}
+	if cfg.SnippetLength != nil && !set["snippet-length"] {
+		snippetLength = *cfg.SnippetLength
+	}
+	if cfg.ShowTo != nil && !set["show-to"] {
+		showTo = *cfg.ShowTo
+	}
+	if cfg.ShowCc != nil && !set["show-cc"] {
+		showCc = *cfg.ShowCc
+	}
+	if cfg.StripQuotes != nil && !set["strip-quotes"] {
+		stripQuotes = *cfg.StripQuotes
+	}
+	if cfg.BodyPrefer != nil && !set["body-prefer"] {
+		bodyPrefer = *cfg.BodyPrefer
+	}
+	if cfg.BodyFirstLine != nil && !set["body-first-line"] {
+		bodyFirstLine = *cfg.BodyFirstLine
+	}
+	if cfg.HeadersOnly != nil && !set["headers-only"] {
+		headersOnly = *cfg.HeadersOnly
+	}
+	if cfg.Color != nil && !set["color"] {
+		colorMode = *cfg.Color
+	}
+	if cfg.NotifyTimeout != nil && !set["notify-timeout"] {
+		notifyTimeout = *cfg.NotifyTimeout
+	}
+	if cfg.Sound != nil && !set["sound"] {
+		sound = *cfg.Sound
+	}
+	if cfg.SummaryTemplate != nil && !set["summary-template"] {
+		summaryTemplate = *cfg.SummaryTemplate
+	}
+	if cfg.BodyTemplate != nil && !set["body-template"] {
+		bodyTemplate = *cfg.BodyTemplate
+	}
+	if cfg.Icon != nil && !set["icon"] {
+		icon = *cfg.Icon
+	}
+	if cfg.Gravatar != nil && !set["gravatar"] {
+		gravatar = *cfg.Gravatar
+	}
+	if cfg.UnreadSummary != nil && !set["unread-summary"] {
+		unreadSummary = *cfg.UnreadSummary
+	}
+	if cfg.MarkRead != nil && !set["mark-read"] {
+		markRead = *cfg.MarkRead
+	}
+	if cfg.OnlyFlagged != nil && !set["only-flagged"] {
+		onlyFlagged = *cfg.OnlyFlagged
+	}
+	if cfg.Category != nil && !set["category"] {
+		category = *cfg.Category
+	}
+	if cfg.GMLabel != nil && !set["gm-label"] {
+		gmLabel = *cfg.GMLabel
+	}
+	if cfg.ShowLabels != nil && !set["show-labels"] {
+		showLabels = *cfg.ShowLabels
+	}
+	if cfg.Since != nil && !set["since"] {
+		since = *cfg.Since
+	}
+	if cfg.ScanDepth != nil && !set["scan-depth"] {
+		scanDepth = *cfg.ScanDepth
+	}
+	if cfg.HistoryFile != nil && !set["history-file"] {
+		historyFile = *cfg.HistoryFile
+	}
+	if cfg.Webhook != nil && !set["webhook"] {
+		webhookURL = *cfg.Webhook
+	}
+	if cfg.SlackWebhook != nil && !set["slack-webhook"] {
+		slackWebhook = *cfg.SlackWebhook
+	}
+	if cfg.DiscordWebhook != nil && !set["discord-webhook"] {
+		discordWebhook = *cfg.DiscordWebhook
+	}
+	if cfg.Exec != nil && !set["exec"] {
+		execCommand = *cfg.Exec
+	}
+	if cfg.Coalesce != nil && !set["coalesce"] {
+		coalesce = *cfg.Coalesce
+	}
+	if cfg.MaxPerMinute != nil && !set["max-per-minute"] {
+		maxPerMinute = *cfg.MaxPerMinute
+	}
+	if cfg.Digest != nil && !set["digest"] {
+		digestInterval = *cfg.Digest
+	}
+	if cfg.NotifyWhen != nil && !set["notify-when"] {
+		notifyWhen = *cfg.NotifyWhen
+	}
+	if cfg.MetricsAddr != nil && !set["metrics-addr"] {
+		metricsAddr = *cfg.MetricsAddr
+	}
+	if cfg.Socket != nil && !set["socket"] {
+		socketPath = *cfg.Socket
+	}
+	if cfg.LogLevel != nil && !set["log-level"] {
+		logLevel = *cfg.LogLevel
+	}
+}
+
+// applyRules sets the options that make up rules, given the flags set on the command line
+func (cfg *fileConfig) applyRules(set map[string]bool) {
+	if cfg.Interval != nil && !set["i"] && !set["interval"] {
+		interval = *cfg.Interval
+	}
+	if cfg.FromAllow != nil && !set["from-allow"] {
+		fromAllow = *cfg.FromAllow
+	}
+	if cfg.FromBlock != nil && !set["from-block"] {
+		fromBlock = *cfg.FromBlock
+	}
+	if cfg.SubjectFilter != nil && !set["subject-filter"] {
+		subjectRe = *cfg.SubjectFilter
+	}
+	if cfg.IgnoreAutomated != nil && !set["ignore-automated"] {
+		ignoreAutomated = *cfg.IgnoreAutomated
+	}
+	if cfg.AutomatedPattern != nil && !set["automated-pattern"] {
+		automatedPattern = *cfg.AutomatedPattern
+	}
+	if cfg.UrgentFrom != nil && !set["urgent-from"] {
+		urgentFrom = *cfg.UrgentFrom
+	}
+	if cfg.UrgentSubject != nil && !set["urgent-subject"] {
+		urgentSubject = *cfg.UrgentSubject
+	}
+	if cfg.QuietStart != nil && !set["quiet-start"] {
+		quietStart = *cfg.QuietStart
+	}
+	if cfg.QuietEnd != nil && !set["quiet-end"] {
+		quietEnd = *cfg.QuietEnd
+	}
+}
+
+// reloadFlags are the options reloadConfig re-reads, see rules
+var reloadFlags = []string{"interval", "from-allow", "from-block", "subject-filter", "ignore-automated", "automated-pattern", "urgent-from", "urgent-subject", "quiet-start", "quiet-end"}
+
+// reloadConfig re-reads the config file on SIGHUP and swaps in the new filter
+// rules and interval. Other options and the stored UIDs are left untouched,
+// and a broken file keeps the current rules
+func reloadConfig() {
+	if configPath == "" {
+		slog.Info("SIGHUP received but no config file to reload")
+		return
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		slog.Error("reloading config failed, keeping current settings", "path", configPath, "err", err)
+		return
+	}
+
+	// Options removed from the file go back to their defaults
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, name := range reloadFlags {
+		if f := flag.Lookup(name); !set[name] && !(name == "interval" && set["i"]) {
+			f.Value.Set(f.DefValue)
+		}
+	}
+	cfg.applyRules(set)
+
+	r, err := buildRules()
+	if err != nil {
+		slog.Error("reloading config failed, keeping current settings", "path", configPath, "err", err)
+		return
+	}
+	setRules(r)
+	slog.Info("config reloaded", "path", configPath, "interval", r.interval)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// readPassword returns the app password(s) from -password-file or
+// -password-stdin, empty if neither is set. Like GMAIL_NOTIFICATIONS, several
+// accounts' passwords are comma-separated
+func readPassword() (string, error) {
+	switch {
+	case passwordFile != "" && passwordStdin:
+		return "", errors.New("-password-file and -password-stdin can't be combined")
+
+	case passwordFile != "":
+		info, err := os.Stat(passwordFile)
+		if err != nil {
+			return "", err
+		}
+		// Permission bits mean little on Windows
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			slog.Warn("password file is readable by other users, consider chmod 600", "path", passwordFile)
+		}
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+
+	case passwordStdin:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("reading password from stdin: %w", err)
+		}
+		return strings.TrimSpace(line), nil
+	}
+	return "", nil
+}
+
+// keyringService is the service name passwords are stored under in the
+// OS keyring (Secret Service on Linux, Keychain on macOS, Credential Manager on Windows)
+const keyringService = "gmail-notifications"
+
+// keyringPassword returns the keyring passwords of the comma-separated
+// users, comma-separated too, or empty unless every user has one stored
+func keyringPassword(users string) string {
+	var passes []string
+	for _, user := range strings.Split(users, ",") {
+		pass, err := keyring.Get(keyringService, strings.TrimSpace(user))
+		if err != nil {
+			if !errors.Is(err, keyring.ErrNotFound) {
+				slog.Debug("keyring unavailable", "account", user, "err", err)
+			}
+			return ""
+		}
+		passes = append(passes, pass)
+	}
+	return strings.Join(passes, ",")
+}
+
+// storePassword saves an account's app password in the OS keyring, for
+// -store-password. It's read from -password-file or -password-stdin, or
+// prompted for on stdin, without echo on a terminal
+func storePassword(user string) error {
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if pass == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		// Typed in, so don't echo it
+		fmt.Fprintf(os.Stderr, "App password for %s: ", user)
+		line, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		pass = strings.TrimSpace(string(line))
+	} else if pass == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("reading password from stdin: %w", err)
+		}
+		pass = strings.TrimSpace(line)
+	}
+	if pass == "" {
+		return errors.New("no password given")
+	}
+	return keyring.Set(keyringService, user, pass)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// daemonEnv marks the detached child started by -daemon
+const daemonEnv = "GMAIL_NOTIFICATIONS_DAEMON"
+
+// pidPath is where a -daemon instance records its PID for -stop
+func pidPath() string {
+	return filepath.Join(stateDir(), "gmail-notifications.pid")
+}
+
+// daemonLogPath receives a -daemon instance's output
+func daemonLogPath() string {
+	return filepath.Join(stateDir(), "daemon.log")
+}
+
+// readPID returns the PID recorded by a -daemon instance, 0 if there's none
+func readPID() int {
+	data, err := os.ReadFile(pidPath())
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+func writePIDFile() error {
+	return writeFileAtomic(pidPath(), []byte(strconv.Itoa(os.Getpid())+"\n"))
+}
+
+// removePIDFile deletes the PID file if it's still ours
+func removePIDFile() {
+	if readPID() == os.Getpid() {
+		os.Remove(pidPath())
+	}
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// running reports whether a process with this PID exists
+func running(pid int) bool {
+	p, err := os.FindProcess(pid)
+	return err == nil && p.Signal(syscall.Signal(0)) == nil
+}
+
+// daemonize re-runs the program in its own session, detached from the
+// terminal with output going to daemonLogPath, and exits. In that child it
+// records the PID file and returns
+func daemonize() error {
+	if pid := readPID(); pid != 0 && pid != os.Getpid() && running(pid) {
+		return fmt.Errorf("already running with PID %d, stop it with -stop", pid)
+	}
+	if os.Getenv(daemonEnv) != "" {
+		return writePIDFile()
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(stateDir(), 0700)
+	logFile, err := os.OpenFile(daemonLogPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("Started in the background with PID %d, logging to %s\n", cmd.Process.Pid, daemonLogPath())
+	os.Exit(0)
+	return nil
+}
+
+// stopDaemon sends SIGTERM to the -daemon instance and waits for it to save
+// its state and exit
+func stopDaemon() error {
+	pid := readPID()
+	if pid == 0 || !running(pid) {
+		os.Remove(pidPath())
+		return errors.New("not running")
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	// Shutdown itself waits up to shutdownTimeout for logouts
+	deadline := time.Now().Add(shutdownTimeout + 5*time.Second)
+	for running(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PID %d didn't exit after %s", pid, shutdownTimeout+5*time.Second)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("Stopped PID %d\n", pid)
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import "errors"
+
+var errNoDaemon = errors.New("-daemon and -stop aren't supported on Windows, use a scheduled task or service wrapper")
+
+func daemonize() error {
+	return errNoDaemon
+}
+
+func stopDaemon() error {
+	return errNoDaemon
+}
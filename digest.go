@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestLines is how many messages a digest lists before "…and N more"
+const digestLines = 10
+
+var (
+	digestByUser = map[string][]newMail{}
+	digestSince  = time.Now()
+	digestMu     sync.Mutex
+)
+
+// queueDigest holds messages for the next -digest notification
+func queueDigest(user string, msgs []newMail) {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	digestByUser[user] = append(digestByUser[user], msgs...)
+	slog.Debug("queued for digest", "account", user, "count", len(msgs), "queued", len(digestByUser[user]))
+}
+
+// runDigest sends the queued messages as one notification per account every
+// interval, and once more on shutdown so nothing queued is lost
+func runDigest(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Quiet hours keep the queue for the first digest after them
+			if !inQuietHours(time.Now()) {
+				flushDigest()
+			}
+		case <-shutdown:
+			flushDigest()
+			return
+		}
+	}
+}
+
+// flushDigest sends and clears every account's queued messages
+func flushDigest() {
+	digestMu.Lock()
+	queued, since := digestByUser, digestSince
+	digestByUser, digestSince = map[string][]newMail{}, time.Now()
+	digestMu.Unlock()
+
+	for user, msgs := range queued {
+		if sendDigest(user, msgs, since) {
+			markDelivered(nil, msgs)
+		}
+	}
+}
+
+// sendDigest notifies about msgs with one line per message, oldest first,
+// and reports whether it went out
+func sendDigest(user string, msgs []newMail, since time.Time) bool {
+	var lines []string
+	for _, m := range msgs[:min(len(msgs), digestLines)] {
+		lines = append(lines, fmt.Sprintf("%s: %s", m.sender, m.subject))
+	}
+	if len(msgs) > digestLines {
+		lines = append(lines, fmt.Sprintf("…and %d more", len(msgs)-digestLines))
+	}
+
+	title := "1 new message"
+	if len(msgs) > 1 {
+		title = fmt.Sprintf("%d new messages", len(msgs))
+	}
+	err := notifier.Send(notification{
+		title:   title + accountLabel(user),
+		subject: "Since " + since.Format("15:04"),
+		body:    strings.Join(lines, "\n"),
+		link:    inboxLink(user),
+	})
+	if err != nil {
+		slog.Error("notification failed", "account", user, "count", len(msgs), "err", err)
+		return false
+	}
+	slog.Info("digest notification sent", "account", user, "count", len(msgs))
+	messagesNotified.Add(int64(len(msgs)))
+	return true
+}
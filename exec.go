@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// execTimeout is how long an -exec command may run before it's killed
+const execTimeout = 30 * time.Second
+
+// execWorker runs -exec commands one at a time, off the watcher goroutine
+var execWorker = sync.OnceValue(func() *worker { return newWorker("exec") })
+
+// runExec queues -exec once per message, it ignores quiet hours and
+// -coalesce. Values are passed as GN_FROM, GN_SUBJECT, GN_DATE, GN_UID and
+// GN_ACCOUNT, and placeholders become references to them, so mail can't
+// inject shell syntax
+func runExec(user string, pending []newMail) {
+	if execCommand == "" {
+		return
+	}
+	for _, m := range pending {
+		vars := []struct{ name, env, value string }{
+			{"{from}", "GN_FROM", m.sender},
+			{"{subject}", "GN_SUBJECT", m.subject},
+			{"{date}", "GN_DATE", m.date.Format(time.RFC3339)},
+			{"{uid}", "GN_UID", strconv.FormatUint(uint64(m.uid), 10)},
+			{"{account}", "GN_ACCOUNT", user},
+		}
+		var replace []string
+		env := os.Environ()
+		for _, v := range vars {
+			replace = append(replace, v.name, placeholder(v.env, v.value))
+			env = append(env, v.env+"="+v.value)
+		}
+		command := strings.NewReplacer(replace...).Replace(execCommand)
+
+		execWorker().run(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+			defer cancel()
+			cmd := shellCommand(ctx, command)
+			cmd.Env = env
+			if out, err := cmd.CombinedOutput(); err != nil {
+				slog.Error("exec command failed", "account", user, "uid", m.uid, "err", err,
+					"output", strings.TrimSpace(string(out)))
+				return
+			}
+			slog.Debug("exec command ran", "account", user, "uid", m.uid)
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand runs command with sh
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// placeholder is a quoted reference to the env variable holding a value. sh
+// expands it after parsing the command, so the value is never run as syntax,
+// but inside quotes added around the placeholder it isn't expanded as one word
+func placeholder(env, value string) string {
+	return `"$` + env + `"`
+}
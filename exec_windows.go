@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// shellCommand runs command with cmd.exe
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
+
+// cmdUnsafeReplacer drops what cmd.exe treats as syntax, so a value stays
+// inert even inside quotes added around the placeholder
+var cmdUnsafeReplacer = strings.NewReplacer(`"`, "", "%", "", "!", "", "^", "", "&", "", "|", "",
+	"<", "", ">", "", "(", "", ")", "", "\r", " ", "\n", " ")
+
+// placeholder is the value itself, double-quoted. cmd.exe expands %VAR%
+// before parsing, so an env reference wouldn't keep mail from injecting syntax
+func placeholder(env, value string) string {
+	return `"` + cmdUnsafeReplacer.Replace(value) + `"`
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	gmailAPI  = "https://gmail.googleapis.com/gmail/v1/users/me"
+	pubsubAPI = "https://pubsub.googleapis.com/v1"
+)
+
+// rewatchInterval renews users.watch well before it expires after 7 days,
+// Google recommends once a day
+const rewatchInterval = 24 * time.Hour
+
+// pullTimeout bounds a Pub/Sub pull, which the server holds open for up to
+// about 90 seconds while there's nothing to deliver
+const pullTimeout = 3 * time.Minute
+
+// gmailAPIClient talks to the Gmail and Pub/Sub REST APIs with an account's
+// OAuth2 access token, which needs the gmail.readonly and pubsub scopes
+type gmailAPIClient struct {
+	acc  account
+	http *http.Client
+}
+
+// Connections go through -proxy and are kept alive between calls, so each
+// call is bounded by its context rather than a deadline on the connection
+func newGmailAPIClient(acc account) *gmailAPIClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if d, ok := httpDialer.(proxy.ContextDialer); ok {
+			return d.DialContext(ctx, network, addr)
+		}
+		return httpDialer.Dial(network, addr)
+	}
+	return &gmailAPIClient{acc: acc, http: &http.Client{Transport: transport}}
+}
+
+// call sends a request with an optional JSON body and decodes the JSON reply into out
+func (g *gmailAPIClient) call(ctx context.Context, method, url string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.acc.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// withTimeout bounds a single API call by -timeout
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// watch asks Gmail to publish mailbox changes to -pubsub-topic and returns
+// the history ID to list changes from
+func (g *gmailAPIClient) watch(ctx context.Context) (uint64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// Gmail API label IDs match IMAP names for system labels like INBOX,
+	// user labels need their ID (e.g. Label_123)
+	in := map[string]any{
+		"topicName":           pubsubTopic,
+		"labelIds":            []string{g.acc.mailbox},
+		"labelFilterBehavior": "include",
+	}
+	var out struct {
+		HistoryID string `json:"historyId"`
+	}
+	if err := g.call(ctx, http.MethodPost, gmailAPI+"/watch", in, &out); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(out.HistoryID, 10, 64)
+}
+
+// pull waits for Pub/Sub messages on -pubsub-subscription, acknowledges them
+// and returns the Gmail addresses they're for. Their payload only carries the
+// address and a history ID, the changes themselves come from history
+func (g *gmailAPIClient) pull(ctx context.Context) ([]string, error) {
+	pullCtx, cancelPull := context.WithTimeout(ctx, pullTimeout)
+	defer cancelPull()
+	var out struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Data string `json:"data"`
+			} `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	if err := g.call(pullCtx, http.MethodPost, pubsubAPI+"/"+pubsubSubscription+":pull",
+		map[string]any{"maxMessages": 100}, &out); err != nil {
+		return nil, err
+	}
+	if len(out.ReceivedMessages) == 0 {
+		return nil, nil
+	}
+
+	var addrs []string
+	ackIDs := make([]string, len(out.ReceivedMessages))
+	for i, m := range out.ReceivedMessages {
+		ackIDs[i] = m.AckID
+		var push struct {
+			EmailAddress string `json:"emailAddress"`
+		}
+		data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+		if err == nil {
+			err = json.Unmarshal(data, &push)
+		}
+		if err != nil {
+			slog.Debug("ignoring malformed Pub/Sub message", "err", err)
+			continue
+		}
+		addrs = append(addrs, push.EmailAddress)
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	err := g.call(ctx, http.MethodPost, pubsubAPI+"/"+pubsubSubscription+":acknowledge",
+		map[string]any{"ackIds": ackIDs}, nil)
+	return addrs, err
+}
+
+// apiPushes wakes the watcher of each gmail-api account, by lowercase
+// address, when runPubSub pulls a push for it
+var apiPushes = map[string]chan struct{}{}
+
+// runPubSub pulls -pubsub-subscription for all gmail-api accounts until
+// shutdown is closed, waking the watcher of the account each push is for.
+// A single puller keeps accounts sharing the subscription from acknowledging
+// each other's pushes. It pulls with the first account's token
+func runPubSub(accs []account) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-shutdown
+		cancel()
+	}()
+
+	acc := accs[0]
+	g := newGmailAPIClient(acc)
+	// The subscription's health is its own, apart from the INBOX watcher
+	// that shares the first account's key
+	sub := account{user: acc.user, mailbox: "Pub/Sub", key: "pubsub"}
+	for ctx.Err() == nil {
+		// Pull blocks until a message arrives or the server gives up
+		addrs, err := g.pull(ctx)
+		for _, addr := range addrs {
+			wake, ok := apiPushes[strings.ToLower(addr)]
+			if !ok {
+				slog.Debug("ignoring push for an account that isn't watched", "address", addr)
+				continue
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+				// A check is already due
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Pub/Sub pull failed", "account", acc.user, "err", err)
+			pollErrors.Add(1)
+			connFailed(sub, err)
+			if !sleep(15 * time.Second) {
+				return
+			}
+			continue
+		}
+		markPolled()
+		connRestored(sub)
+	}
+}
+
+// history returns the IDs of messages added to the watched label since
+// historyID, oldest first, and the history ID to continue from
+func (g *gmailAPIClient) history(ctx context.Context, historyID uint64) ([]string, uint64, error) {
+	var ids []string
+	pageToken := ""
+	for {
+		q := url.Values{
+			"startHistoryId": {strconv.FormatUint(historyID, 10)},
+			"historyTypes":   {"messageAdded"},
+			"labelId":        {g.acc.mailbox},
+		}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		var out struct {
+			History []struct {
+				MessagesAdded []struct {
+					Message struct {
+						ID string `json:"id"`
+					} `json:"message"`
+				} `json:"messagesAdded"`
+			} `json:"history"`
+			HistoryID     string `json:"historyId"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		ctx, cancel := withTimeout(ctx)
+		err := g.call(ctx, http.MethodGet, gmailAPI+"/history?"+q.Encode(), nil, &out)
+		cancel()
+		if err != nil {
+			return nil, historyID, err
+		}
+		for _, h := range out.History {
+			for _, m := range h.MessagesAdded {
+				ids = append(ids, m.Message.ID)
+			}
+		}
+		if out.NextPageToken == "" {
+			next, err := strconv.ParseUint(out.HistoryID, 10, 64)
+			if err != nil {
+				next = historyID
+			}
+			return ids, next, nil
+		}
+		pageToken = out.NextPageToken
+	}
+}
+
+// raw fetches a message in RFC 822 form
+func (g *gmailAPIClient) raw(ctx context.Context, id string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	format := "raw"
+	if !fetchBody() {
+		// Headers only, returned as a list rather than raw
+		format = "metadata"
+	}
+	var out struct {
+		Raw     string `json:"raw"`
+		Payload struct {
+			Headers []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"headers"`
+		} `json:"payload"`
+	}
+	if err := g.call(ctx, http.MethodGet, gmailAPI+"/messages/"+url.PathEscape(id)+"?format="+format, nil, &out); err != nil {
+		return nil, err
+	}
+	if format == "raw" {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(out.Raw, "="))
+	}
+
+	var b bytes.Buffer
+	for _, h := range out.Payload.Headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.Name, h.Value)
+	}
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+// apiWatch follows an account through Gmail API push notifications until
+// shutdown is closed. Changes are tracked from the history ID returned when
+// the watch starts, so mail that arrived while stopped isn't notified.
+// Pushes come through runPubSub, history is also checked every
+// idleCheckInterval in case one was missed
+func apiWatch(acc account) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-shutdown
+		cancel()
+	}()
+
+	g := newGmailAPIClient(acc)
+	wake := apiPushes[strings.ToLower(acc.user)]
+	var historyID uint64
+	var watched time.Time
+	for ctx.Err() == nil {
+		checkIn(acc.key)
+		if time.Since(watched) > rewatchInterval {
+			id, err := g.watch(ctx)
+			if err != nil {
+				slog.Error("Gmail API watch failed", "account", acc.user, "err", err)
+				connectionFailures.Add(1)
+				connFailed(acc, err)
+				if !sleep(time.Minute) {
+					return
+				}
+				continue
+			}
+			if historyID == 0 {
+				historyID = id
+				slog.Info("watching via Gmail API push", "account", acc.user, "history_id", id)
+			}
+			watched = time.Now()
+		}
+
+		src := &apiSource{ctx: ctx, g: g, historyID: historyID}
+		if _, err := checkNew(nil, acc, src, 0, true); err != nil {
+			// An expired history ID can't be listed from, start over from now
+			slog.Error("history list failed, restarting watch", "account", acc.user, "err", err)
+			pollErrors.Add(1)
+			connFailed(acc, err)
+			historyID, watched = 0, time.Time{}
+		} else {
+			connRestored(acc)
+			historyID = src.next
+		}
+
+		select {
+		case <-wake:
+		case <-time.After(idleCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apiSource is the MailSource of a Gmail API watch, new messages are the ones
+// added to the watched label since historyID. Gmail API messages have no
+// UIDs, so lastUID is ignored and next is the history ID to continue from
+type apiSource struct {
+	ctx       context.Context
+	g         *gmailAPIClient
+	historyID uint64
+	next      uint64
+}
+
+func (s *apiSource) FetchNew(uint32) ([]Message, error) {
+	ids, next, err := s.g.history(s.ctx, s.historyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed fetch keeps the history ID, so the next check lists the
+	// messages again. The ones notified before it are caught by Message-ID
+	s.next = s.historyID
+	var msgs []Message
+	for _, id := range ids {
+		raw, err := s.g.raw(s.ctx, id)
+		if err != nil {
+			slog.Error("fetch failed, retrying on the next check", "account", s.g.acc.user, "id", id, "err", err)
+			pollErrors.Add(1)
+			return msgs, nil
+		}
+		msgs = append(msgs, Message{id: id, env: parseEnvelope(raw), body: bytes.NewReader(raw)})
+	}
+	s.next = next
+	return msgs, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// categories are Gmail's inbox tabs -category can watch
+var categories = []string{"primary", "social", "promotions", "updates", "forums"}
+
+// fetchLabels is the Gmail extension item holding a message's labels
+const fetchLabels imap.FetchItem = "X-GM-LABELS"
+
+// gmSearch is a SEARCH with Gmail extension keys appended, like X-GM-RAW,
+// which takes a query in the web UI's search syntax
+type gmSearch struct {
+	criteria *imap.SearchCriteria
+	keys     []interface{}
+}
+
+func (cmd gmSearch) Command() *imap.Command {
+	args := append(cmd.criteria.Format(), cmd.keys...)
+	return &imap.Command{Name: "SEARCH", Arguments: args}
+}
+
+// gmSearchKeys returns the Gmail search keys for -category and -gm-label
+func gmSearchKeys() []interface{} {
+	var keys []interface{}
+	if category != "" {
+		keys = append(keys, imap.RawString("X-GM-RAW"), "category:"+category)
+	}
+	if gmLabel != "" {
+		keys = append(keys, imap.RawString("X-GM-LABELS"), gmLabel)
+	}
+	return keys
+}
+
+// search runs c.Search, or c.UidSearch with uid, narrowed to -category and -gm-label
+func search(c *client.Client, criteria *imap.SearchCriteria, uid bool) ([]uint32, error) {
+	keys := gmSearchKeys()
+	if len(keys) == 0 {
+		if uid {
+			return c.UidSearch(criteria)
+		}
+		return c.Search(criteria)
+	}
+
+	var cmd imap.Commander = gmSearch{criteria: criteria, keys: keys}
+	if uid {
+		cmd = &commands.Uid{Cmd: cmd}
+	}
+	res := new(responses.Search)
+	status, err := c.Execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, fmt.Errorf("gmail search: %w", err)
+	}
+	return res.Ids, nil
+}
+
+// messageLabels returns the X-GM-LABELS of a fetched message, e.g. \Important or Work
+func messageLabels(msg *imap.Message) []string {
+	fields, _ := msg.Items[fetchLabels].([]interface{})
+	var labels []string
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			labels = append(labels, f)
+		case imap.RawString:
+			labels = append(labels, string(f))
+		}
+	}
+	return labels
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// offlineAfter is how many consecutive connection or poll failures make an
+// account count as offline, a single dropped connection is routine
+const offlineAfter = 5
+
+// connHealth tracks the consecutive failures of one mailbox's watcher
+type connHealth struct {
+	failures int
+	offline  bool
+}
+
+var (
+	healthByKey = map[string]*connHealth{}
+	healthMu    sync.Mutex
+)
+
+// connFailed records a failed connection or poll, notifying once the mailbox
+// has failed offlineAfter times in a row so a blind notifier doesn't go unnoticed.
+// Each mailbox has its own watcher, so counts are kept by acc.key
+func connFailed(acc account, err error) {
+	healthMu.Lock()
+	h := healthByKey[acc.key]
+	if h == nil {
+		h = &connHealth{}
+		healthByKey[acc.key] = h
+	}
+	h.failures++
+	notify := h.failures == offlineAfter && !h.offline
+	if notify {
+		h.offline = true
+	}
+	healthMu.Unlock()
+
+	if notify {
+		slog.Warn("account offline", "account", acc.user, "mailbox", acc.mailbox, "failures", offlineAfter, "err", err)
+		sendConnNotice(acc, "Gmail notifier lost connection", err.Error())
+	}
+}
+
+// connRestored records a successful connection or poll, notifying if the
+// mailbox was offline
+func connRestored(acc account) {
+	healthMu.Lock()
+	h := healthByKey[acc.key]
+	notify := h != nil && h.offline
+	delete(healthByKey, acc.key)
+	healthMu.Unlock()
+
+	if notify {
+		slog.Info("account back online", "account", acc.user, "mailbox", acc.mailbox)
+		sendConnNotice(acc, "Gmail notifier connection restored", "Watching for new mail again")
+	}
+}
+
+// sendConnNotice notifies about a mailbox's connection state, not in
+// -tail mode or quiet hours. The mailbox is named when several are watched
+func sendConnNotice(acc account, title, text string) {
+	if tailMode || inQuietHours(time.Now()) {
+		return
+	}
+	if multiMailbox() {
+		text = acc.mailbox + ": " + text
+	}
+	err := notifier.Send(notification{
+		title:   title + accountLabel(acc.user),
+		subject: text,
+		link:    inboxLink(acc.user),
+	})
+	if err != nil {
+		slog.Error("notification failed", "account", acc.user, "err", err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// sessionIdleTime asks the screensaver how long the session has gone without input
+func sessionIdleTime() (time.Duration, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return 0, err
+	}
+	var seconds uint32
+	err = conn.Object("org.freedesktop.ScreenSaver", "/org/freedesktop/ScreenSaver").
+		Call("org.freedesktop.ScreenSaver.GetSessionIdleTime", 0).Store(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
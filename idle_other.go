@@ -0,0 +1,12 @@
+//go:build darwin || windows
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func sessionIdleTime() (time.Duration, error) {
+	return 0, errors.New("the session idle time is only available over D-Bus")
+}
@@ -1,56 +1,536 @@
 package main
 
 import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message/mail"
-	"github.com/esiqveland/notify"
-	"github.com/godbus/dbus/v5"
+	"golang.org/x/net/proxy"
 )
 
-var urlRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+var (
+	accounts           accountList
+	configPath         string
+	msgLenght          int
+	snippetLength      int
+	headersOnly        bool
+	stripQuotes        bool
+	showTo             bool
+	showCc             bool
+	bodyPrefer         string
+	bodyFirstLine      bool
+	readLast           int
+	catchup            int
+	scanDepth          int
+	once               bool
+	searchQuery        string
+	statusMode         bool
+	tailMode           bool
+	reset              bool
+	daemon             bool
+	stop               bool
+	jsonOutput         bool
+	colorMode          string
+	dryRun             bool
+	unreadSummary      bool
+	markRead           bool
+	onlyFlagged        bool
+	category           string
+	gmLabel            string
+	showLabels         bool
+	since              string
+	coalesce           int
+	maxPerMinute       int
+	digestInterval     time.Duration
+	notifyWhen         string
+	quietStart         string
+	quietEnd           string
+	historyFile        string
+	webhookURL         string
+	slackWebhook       string
+	discordWebhook     string
+	execCommand        string
+	interval           time.Duration
+	notifyTimeout      time.Duration
+	sound              string
+	icon               string
+	summaryTemplate    string
+	bodyTemplate       string
+	gravatar           bool
+	logLevel           string
+	verbose            bool
+	metricsAddr        string
+	socketPath         string
+	oauthToken         string
+	passwordFile       string
+	passwordStdin      bool
+	storeUser          string
+	fromAllow          string
+	fromBlock          string
+	subjectRe          string
+	ignoreAutomated    bool
+	automatedPattern   string
+	urgentFrom         string
+	urgentSubject      string
+	mailbox            string
+	imapHost           string
+	imapPort           int
+	protocol           string
+	pubsubTopic        string
+	pubsubSubscription string
+	startTLS           bool
+	compress           bool
+	caCert             string
+	insecureSkipVerify bool
+	proxyURL           string
+	timeout            time.Duration
+	showHelp           bool
+
+	imapDialer client.Dialer
+	httpDialer proxy.Dialer
+	tlsConfig  *tls.Config
+)
+
+// rules holds the settings that SIGHUP can reload while watchers are running
+type rules struct {
+	interval      time.Duration
+	allowPatterns []*regexp.Regexp
+	blockPatterns []*regexp.Regexp
+	subjectFilter *regexp.Regexp
+
+	// automated matches the local part of no-reply style senders, nil
+	// without -ignore-automated
+	automated *regexp.Regexp
+
+	// Mail from urgentPatterns or with a subject matching urgentSubject is
+	// shown with critical urgency
+	urgentPatterns []*regexp.Regexp
+	urgentSubject  *regexp.Regexp
+
+	// Quiet hours window in minutes since midnight, disabled when equal
+	quietStartMin int
+	quietEndMin   int
+
+	// replaced is closed when newer rules are loaded
+	replaced chan struct{}
+}
+
+var activeRules atomic.Pointer[rules]
+
+// currentRules returns the rules in effect
+func currentRules() *rules {
+	return activeRules.Load()
+}
+
+// setRules makes r the rules in effect and wakes anyone waiting on the old ones
+func setRules(r *rules) {
+	if old := activeRules.Swap(r); old != nil {
+		close(old.replaced)
+	}
+}
+
+// buildRules validates and compiles the reloadable options
+func buildRules() (*rules, error) {
+	r := &rules{
+		interval:       interval,
+		allowPatterns:  parsePatterns(fromAllow),
+		blockPatterns:  parsePatterns(fromBlock),
+		urgentPatterns: parsePatterns(urgentFrom),
+		replaced:       make(chan struct{}),
+	}
+
+	if interval < time.Second {
+		return nil, fmt.Errorf("interval must be at least 1s, got %s", interval)
+	}
+
+	if (quietStart == "") != (quietEnd == "") {
+		return nil, errors.New("-quiet-start and -quiet-end must be set together")
+	}
+	if quietStart != "" {
+		var err error
+		if r.quietStartMin, err = parseClock(quietStart); err != nil {
+			return nil, fmt.Errorf("invalid quiet start %q, use HH:MM", quietStart)
+		}
+		if r.quietEndMin, err = parseClock(quietEnd); err != nil {
+			return nil, fmt.Errorf("invalid quiet end %q, use HH:MM", quietEnd)
+		}
+	}
+
+	if subjectRe != "" {
+		re, err := regexp.Compile(subjectRe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject filter %q: %v", subjectRe, err)
+		}
+		r.subjectFilter = re
+	}
+
+	if ignoreAutomated {
+		re, err := regexp.Compile("(?i)" + automatedPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid automated sender pattern %q: %v", automatedPattern, err)
+		}
+		r.automated = re
+	}
+
+	if urgentSubject != "" {
+		re, err := regexp.Compile(urgentSubject)
+		if err != nil {
+			return nil, fmt.Errorf("invalid urgent subject %q: %v", urgentSubject, err)
+		}
+		r.urgentSubject = re
+	}
+	return r, nil
+}
+
+// defaultAutomatedPattern matches the local part of common transactional
+// senders like no-reply@, notifications@, mailer-daemon@ and bounce-123@
+const defaultAutomatedPattern = `^(no-?reply|do-?not-?reply|notifications?|mailer-daemon|bounces?)([+._-].*)?$`
+
+// automatedSender reports whether sender's local part matches -automated-pattern
+func automatedSender(sender string) bool {
+	re := currentRules().automated
+	if re == nil {
+		return false
+	}
+	local, _, _ := strings.Cut(sender, "@")
+	return re.MatchString(local)
+}
+
+// email is a fetched message as printed by -read -json
+type email struct {
+	Account string `json:"account,omitempty"`
+	From    string `json:"from"`
+	Date    string `json:"date"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	UID     uint32 `json:"uid"`
+}
+
+// The parsed -since, either a fixed time or an age
+var (
+	sinceTime time.Time
+	sinceAge  time.Duration
+)
+
+// jsonEmails collects emails in -json mode, printed once all accounts are read
+var jsonEmails = []email{}
+
+// lastUnread holds the unread count per mailbox for -unread-summary
+var (
+	lastUnread = map[string]int{}
+	unreadMu   sync.Mutex
+)
+
+// outputMu keeps messages printed by concurrent account watchers from interleaving
+var outputMu sync.Mutex
+
+// account holds credentials for a single watched mailbox
+// token, when set, is an OAuth2 access token used instead of pass
+// key names the mailbox's UID state, see watchMailboxes
+type account struct {
+	user    string
+	pass    string
+	token   string
+	mailbox string
+	key     string
+}
+
+// watchMailboxes returns an entry per account and -mailbox, so each mailbox
+// gets its own connection and UID state. The first mailbox keeps the
+// account's plain state key, so single-mailbox setups keep their state
+func watchMailboxes(accs []account, mailboxes []string) []account {
+	var out []account
+	for _, acc := range accs {
+		for i, name := range mailboxes {
+			acc.mailbox, acc.key = name, acc.user
+			if i > 0 {
+				acc.key = acc.user + "_" + stateKeyReplacer.Replace(name)
+			}
+			out = append(out, acc)
+		}
+	}
+	return out
+}
+
+// stateKeyReplacer makes mailbox names like "[Gmail]/Important" safe in file names
+var stateKeyReplacer = strings.NewReplacer("/", "_", "\\", "_", "[", "", "]", "", " ", "_")
+
+// multiAccount reports whether more than one address is watched, so output
+// says which one a message is for
+func multiAccount() bool {
+	for _, acc := range accounts {
+		if acc.user != accounts[0].user {
+			return true
+		}
+	}
+	return false
+}
+
+// multiMailbox reports whether more than one mailbox is watched per account
+func multiMailbox() bool {
+	for _, acc := range accounts {
+		if acc.key != acc.user {
+			return true
+		}
+	}
+	return false
+}
+
+// accountList implements flag.Value for the repeatable -account flag
+type accountList []account
+
+func (a *accountList) String() string {
+	users := make([]string, len(*a))
+	for i, acc := range *a {
+		users[i] = acc.user
+	}
+	return strings.Join(users, ",")
+}
+
+func (a *accountList) Set(value string) error {
+	user, pass, ok := strings.Cut(value, ":")
+	if !ok || user == "" || pass == "" {
+		return errors.New("expected user:pass")
+	}
+	*a = append(*a, account{user: user, pass: pass})
+	return nil
+}
+
+const (
+	defaultIMAPHost = "imap.gmail.com"
+	defaultIMAPPort = 993
+)
+
+// minLength leaves room for at least one character before "..."
+const minLength = 4
+
+// defaultLength is the -length default
+const defaultLength = 500
+
+// shutdownTimeout bounds how long exiting waits for logouts
+const shutdownTimeout = 10 * time.Second
+
+const (
+	maxConnectAttempts = 8
+	maxBackoff         = 60 * time.Second
+)
 
 var (
-	user      string
-	pass      string
-	msgLenght int
-	readLast  int
-	showHelp  bool
+	errIdleUnsupported = errors.New("server does not support IDLE")
+	errShutdown        = errors.New("shutting down")
 )
 
-const uidFile = ".gmail_last_uid.txt"
+// shutdown is closed on SIGINT/SIGTERM to stop all watchers
+var shutdown = make(chan struct{})
+
+// sleep waits for d, returning false early if shutdown is closed
+func sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-shutdown:
+		return false
+	}
+}
 
 func usage() {
 	fmt.Printf(`Gmail Notifications - Monitors Gmail and sends desktop notifications
 
 Usage: %s [OPTIONS]
 
-Environment Variables (required):
-  GMAIL_USER               Gmail address
-  GMAIL_READER             Gmail app password
+Environment Variables (required unless -account or -config is used):
+  GMAIL_USER                   Gmail address (comma-separated for multiple accounts)
+  GMAIL_NOTIFICATIONS          Gmail app password (comma-separated, same order)
+  GMAIL_OAUTH_TOKEN            OAuth2 access token, used instead of the app password
 
 Options:
-  -l, --length <int>       Message body length for notifications (default: 500, 0=disable)
-  -r, --read <int>         Read last x emails to stdout and exit
-  -h, --help               Show this help message
+  -c, --config <path>          TOML config file, flags and env vars override its values
+  -a, --account <user:pass>    Watch an account (repeatable, overrides env vars)
+  --imap-host <host>           IMAP server for non-Gmail providers (default: imap.gmail.com)
+  --imap-port <port>           IMAP server port (default: 993, 995 with -protocol pop3)
+  --protocol, --backend <name> imap, pop3, or gmail-api for Gmail API push via Pub/Sub (default: imap)
+  --pubsub-topic <name>        With gmail-api, the topic Gmail publishes to, e.g. projects/p/topics/gmail
+  --pubsub-subscription <name> With gmail-api, the pull subscription on that topic
+  --starttls                   Connect in plaintext and upgrade with STARTTLS (e.g. port 143)
+  --compress                   Compress the IMAP connection with COMPRESS=DEFLATE when the server offers it
+  --ca-cert <path>             Trust the CA certificate(s) in this PEM file, for self-hosted servers
+  --insecure-skip-verify       Don't verify the server certificate (testing only, unsafe)
+  --proxy <url>                Connect through a socks5:// or http:// proxy
+  --timeout <duration>         Give up on connecting or an IMAP command after this long (default: 1m, 0=never)
+  -i, --interval <duration>    Poll interval when IDLE is unavailable (default: 15s, min: 1s)
+  -o, --oauth-token <token>    OAuth2 access token (overrides GMAIL_OAUTH_TOKEN)
+  --password-file <path>       Read the app password from this file instead of GMAIL_NOTIFICATIONS
+  --password-stdin             Read the app password from the first line of stdin
+  --store-password <user>      Save the app password for user in the OS keyring and exit
+  --from-allow <patterns>      Only notify for senders matching these comma-separated patterns (* wildcard)
+  --from-block <patterns>      Never notify for senders matching these comma-separated patterns (* wildcard)
+  --subject-filter <regexp>    Only notify for subjects matching this regular expression
+  --ignore-automated           Skip no-reply@, notifications@, mailer-daemon@ and bounce@ style senders
+  --automated-pattern <regexp> Sender local parts -ignore-automated skips (default: no-reply, notifications, ...)
+  --urgent-from <patterns>     Show mail from senders matching these comma-separated patterns as critical (* wildcard)
+  --urgent-subject <regexp>    Show mail with subjects matching this regular expression as critical
+  -m, --mailbox <name>         Mailbox or Gmail label to watch, e.g. "[Gmail]/Important", comma-separated for several (default: INBOX)
+  --show-to                    Show the To addresses of each email
+  --show-cc                    Show the Cc addresses of each email
+  --strip-quotes               Leave quoted replies ("> ..." and "On ... wrote:") out of bodies
+  --body-prefer <part>         Body part to show: plain, html or first (default: plain)
+  --body-first-line            Show only the first non-empty line of the body
+  --headers-only               Fetch only the From, To, Cc, Subject, Date, Message-ID and In-Reply-To headers, no body (saves bandwidth)
+  -l, --length <int|auto>      Message body length in characters, auto fits the terminal (default: 500, min: 4, 0=disable)
+  --snippet-length <int>       Show a one-line snippet this long in notifications instead of the body, e.g. 140 (default: 0=off)
+  -r, --read <int>             Read last x emails to stdout and exit
+  --status                     Print the unread count for a status bar (i3blocks, or waybar with -json) and exit
+  --search <query>             Print emails matching a query and exit, e.g. "from:boss@corp.com since:7d unread"
+  --catchup <int>              Print the last x emails on startup, then keep watching
+  --scan-depth <int>           Newest messages to notify for when there's no stored UID yet (default: 1)
+  --once                       Check for new mail once, notify, save state and exit (for cron)
+  --daemon                     Run in the background, writing a PID file to the state directory
+  --stop                       Stop the instance started with -daemon, letting it save its state
+  --reset                      Delete the stored UIDs and Message-ID caches of all accounts and exit
+  --tail                       Keep watching and print new mail to stdout, without notifications or webhooks
+  --color <when>               Color the printed emails: auto, always or never (default: auto, honors NO_COLOR)
+  -j, --json                   With -read or -search, print emails as a JSON array instead
+  --notify-timeout <duration>  How long notifications stay on screen (default: 10s, 0=until dismissed)
+  --summary-template <tmpl>    Go template for the notification title, e.g. "{{.From}} ({{.Date}})"
+  --body-template <tmpl>       Go template for the notification text, fields .From .Subject .Date .Body .Account
+  --icon <name|path>           Notification icon, a themed icon name or image file (default: mail-unread)
+  --gravatar                   Use the sender's Gravatar as the notification icon when they have one
+  --sound <name|path>          Play a themed sound (e.g. message-new-instant) or sound file (Linux only)
+  --digest <duration>          Instead of notifying right away, send one summary of new mail every interval, e.g. 30m
+  --notify-when <mode>         Notify always, only while you're active, or only while idle, holding the rest back (default: always)
+  --max-per-minute <int>       Cap notifications per minute across accounts, the rest are summarized (default: 0=no limit)
+  --coalesce <int>             Send one summary when more than this many emails arrive at once (default: 5, 0=never)
+  --quiet-start <HH:MM>        Start of daily quiet hours, no notifications but mail is still tracked
+  --quiet-end <HH:MM>          End of daily quiet hours (may cross midnight, e.g. 22:00-07:00)
+  --webhook <url>              Also POST each new email as JSON to this URL
+  --slack-webhook <url>        Also post each new email to a Slack incoming webhook
+  --discord-webhook <url>      Also post each new email to a Discord webhook
+  --exec <command>             Run a shell command for each new email, with unquoted {from}, {subject}, {date}, {uid} and {account} or $GN_FROM etc. filled in
+  --history-file <path>        Append a line per notified email to this file
+  --since <time|duration>      Don't notify for mail dated before this RFC 3339 time, or older than this duration, e.g. 24h
+  --only-flagged               Only notify for flagged (starred) messages, e.g. starred by a Gmail filter
+  --category <tab>             Only notify for mail in this Gmail inbox tab: primary, social, promotions, updates or forums
+  --gm-label <label>           Only notify for mail with this Gmail label
+  --show-labels                Show the message's Gmail labels in notifications
+  --mark-read                  Mark messages read once notified (bodies are fetched without marking them otherwise)
+  --unread-summary             Also notify with the unread count whenever it changes
+  --dry-run                    Print and notify without advancing the stored UID
+  --socket <path>              Write a JSON line per new email to clients of this Unix socket
+  --metrics-addr <addr>        Serve Prometheus metrics on this address, e.g. :9090
+  --log-level <level>          Log verbosity on stderr: error, info or debug (default: info)
+  -v, --verbose                Log every step: connecting, login, select, fetch, filter and notify (same as --log-level debug)
+  -h, --help                   Show this help message
 `, os.Args[0])
 }
 
 func main() {
-	flag.IntVar(&msgLenght, "l", 500, "")
-	flag.IntVar(&msgLenght, "length", 500, "")
+	flag.StringVar(&configPath, "c", "", "")
+	flag.StringVar(&configPath, "config", "", "")
+	flag.StringVar(&imapHost, "imap-host", defaultIMAPHost, "")
+	flag.IntVar(&imapPort, "imap-port", defaultIMAPPort, "")
+	flag.StringVar(&protocol, "protocol", "imap", "")
+	flag.StringVar(&protocol, "backend", "imap", "")
+	flag.StringVar(&pubsubTopic, "pubsub-topic", "", "")
+	flag.StringVar(&pubsubSubscription, "pubsub-subscription", "", "")
+	flag.BoolVar(&startTLS, "starttls", false, "")
+	flag.BoolVar(&compress, "compress", false, "")
+	flag.StringVar(&caCert, "ca-cert", "", "")
+	flag.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "")
+	flag.StringVar(&proxyURL, "proxy", "", "")
+	flag.DurationVar(&timeout, "timeout", time.Minute, "")
+	flag.DurationVar(&interval, "i", 15*time.Second, "")
+	flag.DurationVar(&interval, "interval", 15*time.Second, "")
+	flag.StringVar(&oauthToken, "o", "", "")
+	flag.StringVar(&oauthToken, "oauth-token", "", "")
+	flag.StringVar(&passwordFile, "password-file", "", "")
+	flag.BoolVar(&passwordStdin, "password-stdin", false, "")
+	flag.StringVar(&storeUser, "store-password", "", "")
+	flag.StringVar(&fromAllow, "from-allow", "", "")
+	flag.StringVar(&fromBlock, "from-block", "", "")
+	flag.StringVar(&subjectRe, "subject-filter", "", "")
+	flag.StringVar(&urgentFrom, "urgent-from", "", "")
+	flag.StringVar(&urgentSubject, "urgent-subject", "", "")
+	flag.BoolVar(&ignoreAutomated, "ignore-automated", false, "")
+	flag.StringVar(&automatedPattern, "automated-pattern", defaultAutomatedPattern, "")
+	flag.BoolVar(&headersOnly, "headers-only", false, "")
+	flag.StringVar(&mailbox, "m", "INBOX", "")
+	flag.StringVar(&mailbox, "mailbox", "INBOX", "")
+	flag.BoolVar(&showTo, "show-to", false, "")
+	flag.BoolVar(&showCc, "show-cc", false, "")
+	flag.BoolVar(&stripQuotes, "strip-quotes", false, "")
+	flag.StringVar(&bodyPrefer, "body-prefer", "plain", "")
+	flag.BoolVar(&bodyFirstLine, "body-first-line", false, "")
+	msgLenght = defaultLength
+	flag.Var(lengthValue{}, "l", "")
+	flag.Var(lengthValue{}, "length", "")
+	flag.IntVar(&snippetLength, "snippet-length", 0, "")
 	flag.IntVar(&readLast, "r", 0, "")
 	flag.IntVar(&readLast, "read", 0, "")
+	flag.IntVar(&catchup, "catchup", 0, "")
+	flag.IntVar(&scanDepth, "scan-depth", 1, "")
+	flag.Var(&accounts, "a", "")
+	flag.Var(&accounts, "account", "")
+	flag.BoolVar(&once, "once", false, "")
+	flag.StringVar(&searchQuery, "search", "", "")
+	flag.BoolVar(&statusMode, "status", false, "")
+	flag.BoolVar(&tailMode, "tail", false, "")
+	flag.BoolVar(&reset, "reset", false, "")
+	flag.BoolVar(&daemon, "daemon", false, "")
+	flag.BoolVar(&stop, "stop", false, "")
+	flag.StringVar(&colorMode, "color", "auto", "")
+	flag.BoolVar(&jsonOutput, "j", false, "")
+	flag.BoolVar(&jsonOutput, "json", false, "")
+	flag.DurationVar(&notifyTimeout, "notify-timeout", 10*time.Second, "")
+	flag.StringVar(&summaryTemplate, "summary-template", "", "")
+	flag.StringVar(&bodyTemplate, "body-template", "", "")
+	flag.StringVar(&icon, "icon", "mail-unread", "")
+	flag.BoolVar(&gravatar, "gravatar", false, "")
+	flag.StringVar(&sound, "sound", "", "")
+	flag.IntVar(&maxPerMinute, "max-per-minute", 0, "")
+	flag.DurationVar(&digestInterval, "digest", 0, "")
+	flag.StringVar(&notifyWhen, "notify-when", "always", "")
+	flag.IntVar(&coalesce, "coalesce", 5, "")
+	flag.StringVar(&quietStart, "quiet-start", "", "")
+	flag.StringVar(&quietEnd, "quiet-end", "", "")
+	flag.StringVar(&webhookURL, "webhook", "", "")
+	flag.StringVar(&slackWebhook, "slack-webhook", "", "")
+	flag.StringVar(&discordWebhook, "discord-webhook", "", "")
+	flag.StringVar(&execCommand, "exec", "", "")
+	flag.StringVar(&historyFile, "history-file", "", "")
+	flag.StringVar(&since, "since", "", "")
+	flag.BoolVar(&onlyFlagged, "only-flagged", false, "")
+	flag.StringVar(&category, "category", "", "")
+	flag.StringVar(&gmLabel, "gm-label", "", "")
+	flag.BoolVar(&showLabels, "show-labels", false, "")
+	flag.BoolVar(&markRead, "mark-read", false, "")
+	flag.BoolVar(&unreadSummary, "unread-summary", false, "")
+	flag.BoolVar(&dryRun, "dry-run", false, "")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "")
+	flag.StringVar(&socketPath, "socket", "", "")
+	flag.StringVar(&logLevel, "log-level", "info", "")
+	flag.BoolVar(&verbose, "v", false, "")
+	flag.BoolVar(&verbose, "verbose", false, "")
 	flag.BoolVar(&showHelp, "h", false, "")
 	flag.BoolVar(&showHelp, "help", false, "")
 	flag.Usage = usage
@@ -61,185 +541,1550 @@ func main() {
 		return
 	}
 
-	if user = os.Getenv("GMAIL_USER"); user == "" {
-		fmt.Println("Error: GMAIL_USER (gmail address) environment variable must be set")
+	cfg := &fileConfig{}
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: reading config %s: %v\n", configPath, err)
+			os.Exit(1)
+		}
+		cfg.apply()
+	}
+
+	if verbose {
+		logLevel = "debug"
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid log level %q, use error, info or debug\n", logLevel)
 		os.Exit(1)
 	}
-	if pass = os.Getenv("GMAIL_NOTIFICATIONS"); pass == "" {
-		fmt.Println("Error: GMAIL_NOTIFICATIONS (app password) environment variable must be set")
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if stop {
+		if err := stopDaemon(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if daemon && passwordStdin {
+		fmt.Fprintln(os.Stderr, "Error: -daemon can't read the password from stdin, use -password-file or the keyring")
 		os.Exit(1)
 	}
 
-	// Read last x emails and exit
-	if readLast > 0 {
-		readEmails(user, pass, readLast, nil)
+	if reset {
+		n, err := resetState()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d state files from %s\n", n, stateDir())
+		return
+	}
+
+	if storeUser != "" {
+		if err := storePassword(storeUser); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: storing password in the keyring: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Password for %s saved in the keyring\n", storeUser)
 		return
 	}
 
-	lastUID := loadUID()
+	if jsonOutput && readLast <= 0 && searchQuery == "" && !statusMode {
+		fmt.Fprintln(os.Stderr, "Error: -json can only be used with -read, -search or -status")
+		os.Exit(1)
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	color, err := colorEnabled(colorMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	useColor = color
 
-	ticker := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
+	if scanDepth < 1 {
+		fmt.Fprintf(os.Stderr, "Error: scan depth must be at least 1, got %d\n", scanDepth)
+		os.Exit(1)
+	}
 
-	readEmails(user, pass, 1, &lastUID)
+	if compress && startTLS {
+		fmt.Fprintln(os.Stderr, "Error: -compress needs a TLS connection from the start, it can't be used with -starttls")
+		os.Exit(1)
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			readEmails(user, pass, 1, &lastUID)
-		case <-sigChan:
-			return
-		}
+	if tailMode && (readLast > 0 || markRead || unreadSummary) {
+		fmt.Fprintln(os.Stderr, "Error: -tail only prints, it can't be used with -read, -mark-read or -unread-summary")
+		os.Exit(1)
 	}
-}
 
-func saveUID(uid uint32) {
-	os.WriteFile(uidFile, []byte(strconv.FormatUint(uint64(uid), 10)), 0644)
-}
+	if lengthAuto {
+		msgLenght = autoLength(defaultLength)
+	}
+	if headersOnly {
+		msgLenght, snippetLength = 0, 0
+	}
+	if msgLenght < 0 || (msgLenght > 0 && msgLenght < minLength) {
+		fmt.Fprintf(os.Stderr, "Error: length must be 0 (disabled) or at least %d, got %d\n", minLength, msgLenght)
+		os.Exit(1)
+	}
+	if snippetLength < 0 || (snippetLength > 0 && snippetLength < minLength) {
+		fmt.Fprintf(os.Stderr, "Error: snippet length must be 0 (disabled) or at least %d, got %d\n", minLength, snippetLength)
+		os.Exit(1)
+	}
 
-func loadUID() uint32 {
-	data, err := os.ReadFile(uidFile)
-	if err != nil {
-		return 0
+	if notifyTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Error: notify timeout can't be negative, got %s\n", notifyTimeout)
+		os.Exit(1)
 	}
-	uid, _ := strconv.ParseUint(string(data), 10, 32)
-	return uint32(uid)
-}
 
-// truncateBody truncates text without cutting URLs
-// If cutting would split a URL, cuts before the URL instead
-func truncateBody(text string, maxLen int) string {
-	if len(text) <= maxLen {
-		return text
+	switch bodyPrefer {
+	case "plain", "html", "first":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown body part %q, use plain, html or first\n", bodyPrefer)
+		os.Exit(1)
 	}
 
-	// Find all URLs and their positions
-	urls := urlRegex.FindAllStringIndex(text, -1)
+	switch protocol {
+	case "imap":
+	case "pop3":
+		if markRead || unreadSummary || onlyFlagged || searchQuery != "" || statusMode {
+			fmt.Fprintln(os.Stderr, "Error: -mark-read, -unread-summary, -only-flagged, -search and -status need IMAP")
+			os.Exit(1)
+		}
+		// The IMAP default port makes no sense for POP3
+		if imapPort == defaultIMAPPort {
+			imapPort = defaultPOP3Port
+		}
+	case "gmail-api":
+		if markRead || unreadSummary || onlyFlagged || readLast > 0 || once || catchup > 0 || searchQuery != "" || statusMode {
+			fmt.Fprintln(os.Stderr, "Error: -mark-read, -unread-summary, -only-flagged, -read, -once and -catchup need IMAP or POP3, -search and -status need IMAP")
+			os.Exit(1)
+		}
+		if pubsubTopic == "" || pubsubSubscription == "" {
+			fmt.Fprintln(os.Stderr, "Error: -protocol gmail-api needs -pubsub-topic and -pubsub-subscription")
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown protocol %q, use imap, pop3 or gmail-api\n", protocol)
+		os.Exit(1)
+	}
+	if (category != "" || gmLabel != "" || showLabels) && protocol != "imap" {
+		fmt.Fprintln(os.Stderr, "Error: -category, -gm-label and -show-labels need Gmail over IMAP")
+		os.Exit(1)
+	}
+	if category != "" {
+		if !slices.Contains(categories, category) {
+			fmt.Fprintf(os.Stderr, "Error: unknown category %q, use %s\n", category, strings.Join(categories, ", "))
+			os.Exit(1)
+		}
+	}
 
-	// Find safe cut point
-	cutPoint := maxLen - 3 // leave room for "..."
+	notifyLimiter.perMinute = maxPerMinute
 
-	for _, url := range urls {
-		urlStart, urlEnd := url[0], url[1]
+	if since != "" {
+		if err := parseSinceFlag(since); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	parseTemplates()
 
-		// If cut point is inside a URL, move it before the URL
-		if cutPoint > urlStart && cutPoint < urlEnd {
-			cutPoint = urlStart
-			break
+	if digestInterval < 0 || (digestInterval > 0 && digestInterval < time.Minute) {
+		fmt.Fprintf(os.Stderr, "Error: digest interval must be 0 (off) or at least 1m, got %s\n", digestInterval)
+		os.Exit(1)
+	}
+	switch notifyWhen {
+	case "always":
+	case "active", "idle":
+		if once {
+			fmt.Fprintln(os.Stderr, "Error: -notify-when needs the watch loop, it can't be used with -once")
+			os.Exit(1)
+		}
+		if _, err := sessionIdleTime(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -notify-when %s needs the session idle time: %v\n", notifyWhen, err)
+			os.Exit(1)
 		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown -notify-when %q, use always, active or idle\n", notifyWhen)
+		os.Exit(1)
 	}
 
-	// If cut point is 0 or negative (URL at start is too long), skip body
-	if cutPoint <= 0 {
-		return ""
+	if digestInterval > 0 && once {
+		fmt.Fprintln(os.Stderr, "Error: -digest needs the watch loop, it can't be used with -once")
+		os.Exit(1)
 	}
 
-	return text[:cutPoint] + "..."
-}
+	if timeout < 0 {
+		fmt.Fprintf(os.Stderr, "Error: timeout can't be negative, got %s\n", timeout)
+		os.Exit(1)
+	}
 
-func sendNotification(sender, subject, body string) {
-	conn, err := dbus.SessionBus()
+	r, err := buildRules()
 	if err != nil {
-		return
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
-	notifier, _ := notify.New(conn)
+	setRules(r)
 
-	_, _ = notifier.SendNotification(notify.Notification{
-		AppName:       "Gmail Notifications",
-		Summary:       fmt.Sprintf("From: %s", sender),
-		Body:          fmt.Sprintf("<b>%s</b>\n\n%s", subject, body),
-		ExpireTimeout: 10000, // 10 seconds
-	})
-}
+	if tlsConfig, err = newTLSConfig(caCert, insecureSkipVerify); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if insecureSkipVerify {
+		slog.Warn("!!! TLS certificate verification is DISABLED (-insecure-skip-verify), anyone on the network can read your credentials and mail !!!")
+	}
 
-// readEmails fetches emails from Gmail
-// count: number of emails to fetch
-// lastUID: if not nil, only process emails newer than this UID and update it
-func readEmails(user, pass string, count int, lastUID *uint32) {
-	c, err := client.DialTLS("imap.gmail.com:993", nil)
-	if err != nil {
+	if imapDialer, err = newDialer(proxyURL, timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid proxy %q: %v\n", proxyURL, err)
+		os.Exit(1)
+	}
+	httpDialer, _ = proxyDialer(proxyURL, timeout)
+	notifier = withWebhooks(notifier)
+	defer stopWorkers(shutdownTimeout)
+
+	if len(accounts) == 0 {
+		user := cmp.Or(os.Getenv("GMAIL_USER"), cfg.User)
+		if user == "" {
+			fmt.Println("Error: GMAIL_USER (gmail address) environment variable or config user must be set")
+			os.Exit(1)
+		}
+		oauthToken = cmp.Or(oauthToken, os.Getenv("GMAIL_OAUTH_TOKEN"), cfg.OAuthToken)
+		filePass, err := readPassword()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Passwords saved with -store-password win over env vars. The keyring
+		// is only asked when -password-file or -password-stdin gave nothing
+		pass := filePass
+		if pass == "" {
+			pass = cmp.Or(keyringPassword(user), os.Getenv("GMAIL_NOTIFICATIONS"), cfg.Password)
+		}
+		if pass == "" && oauthToken == "" {
+			fmt.Println("Error: GMAIL_NOTIFICATIONS (app password) or GMAIL_OAUTH_TOKEN environment variable, -password-file, -password-stdin or config password must be set")
+			os.Exit(1)
+		}
+
+		users := strings.Split(user, ",")
+		passes := make([]string, len(users))
+		tokens := make([]string, len(users))
+		if pass != "" {
+			passes = strings.Split(pass, ",")
+		}
+		if oauthToken != "" {
+			tokens = strings.Split(oauthToken, ",")
+		}
+		if len(users) != len(passes) || len(users) != len(tokens) {
+			fmt.Println("Error: GMAIL_USER and its credentials must list the same number of accounts")
+			os.Exit(1)
+		}
+		for i := range users {
+			accounts = append(accounts, account{
+				user:  strings.TrimSpace(users[i]),
+				pass:  strings.TrimSpace(passes[i]),
+				token: strings.TrimSpace(tokens[i]),
+			})
+		}
+	}
+
+	if protocol == "gmail-api" {
+		for _, acc := range accounts {
+			if acc.token == "" {
+				fmt.Fprintf(os.Stderr, "Error: -protocol gmail-api needs an OAuth token for %s\n", acc.user)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var mailboxes []string
+	for _, name := range strings.Split(mailbox, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			mailboxes = append(mailboxes, name)
+		}
+	}
+	if len(mailboxes) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -mailbox must name at least one mailbox")
+		os.Exit(1)
+	}
+	if len(mailboxes) > 1 && (protocol == "pop3" || protocol == "gmail-api") {
+		fmt.Fprintf(os.Stderr, "Error: -protocol %s watches a single mailbox\n", protocol)
+		os.Exit(1)
+	}
+	accounts = watchMailboxes(accounts, mailboxes)
+
+	// Print the unread count for a status bar and exit
+	if statusMode {
+		printStatus()
 		return
 	}
-	defer c.Logout()
 
-	if err := c.Login(user, pass); err != nil {
+	// Print matching emails and exit
+	if searchQuery != "" {
+		criteria, err := parseSearch(searchQuery)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, acc := range accounts {
+			searchEmails(acc, criteria)
+		}
+		if jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(jsonEmails)
+		}
 		return
 	}
 
-	mbox, _ := c.Select("INBOX", false)
-	if mbox.Messages == 0 {
+	// Read last x emails and exit
+	if readLast > 0 {
+		for _, acc := range accounts {
+			if protocol == "pop3" {
+				readPOP3(acc, readLast)
+				continue
+			}
+			readEmails(acc, readLast, nil)
+		}
+		if jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(jsonEmails)
+		}
 		return
 	}
 
-	// Calculate range for last x emails
-	from := mbox.Messages
-	if uint32(count) < mbox.Messages {
-		from = mbox.Messages - uint32(count) + 1
+	// Check once against the stored UID and exit, for cron
+	if once {
+		for _, acc := range accounts {
+			if protocol == "pop3" {
+				pollPOP3(acc)
+				continue
+			}
+			state := loadUID(acc.key)
+			readEmails(acc, scanDepth, state)
+		}
+		return
 	}
 
-	seqset := new(imap.SeqSet)
-	seqset.AddRange(from, mbox.Messages)
+	if daemon {
+		if err := daemonize(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer removePIDFile()
+	}
 
-	// Fetch Envelope, UID, and optionally Body (Peek=true to not mark as read)
-	section := &imap.BodySectionName{Peek: true}
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
-	if msgLenght > 0 {
-		items = append(items, section.FetchItem())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+	if socketPath != "" {
+		if err := serveSocket(socketPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: opening socket %s: %v\n", socketPath, err)
+			os.Exit(1)
+		}
+	}
+
+	// Show recent mail right away, so it's clear the tool works before new mail arrives
+	if catchup > 0 {
+		for _, acc := range accounts {
+			if protocol == "pop3" {
+				readPOP3(acc, catchup)
+				continue
+			}
+			readEmails(acc, catchup, nil)
+		}
+	}
+
+	go runWatchdog()
+
+	var wg sync.WaitGroup
+	if digestInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runDigest(digestInterval)
+		}()
+	}
+	if notifyWhen != "always" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runDeferred()
+		}()
+	}
+	if protocol == "gmail-api" {
+		// Set up before the watchers wait on their pushes
+		for _, acc := range accounts {
+			apiPushes[strings.ToLower(acc.user)] = make(chan struct{}, 1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runPubSub(accounts)
+		}()
+	}
+	for _, acc := range accounts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watch(acc)
+		}()
+	}
+
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadConfig()
 	}
+	slog.Info("shutting down")
+	close(shutdown)
 
-	messages := make(chan *imap.Message, count)
+	// Give watchers time to log out cleanly, but don't hang on a dead server
+	done := make(chan struct{})
 	go func() {
-		c.Fetch(seqset, items, messages)
+		wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("timed out waiting for connections to close")
+	}
+}
 
-	for msg := range messages {
-		// In daemon mode, skip already seen emails and update UID
-		if lastUID != nil {
-			if *lastUID != 0 && msg.Uid <= *lastUID {
-				continue
-			}
-			*lastUID = msg.Uid
-			saveUID(msg.Uid)
+// watch monitors a single account until shutdown is closed
+func watch(acc account) {
+	switch protocol {
+	case "pop3":
+		pop3Watch(acc)
+		return
+	case "gmail-api":
+		apiWatch(acc)
+		return
+	}
+
+	checkIn(acc.key)
+	state := loadUID(acc.key)
+
+	// Flush the UID one last time on the way out
+	defer func() {
+		if !dryRun {
+			state.save()
 		}
+	}()
 
-		sender := msg.Envelope.From[0].Address()
-		subject := msg.Envelope.Subject
-		date := msg.Envelope.Date.Format("2006-01-02 15:04")
+	// Prefer IDLE, fall back to polling if the server doesn't support it
+	if err := idleWatch(acc, state); err == errShutdown {
+		return
+	}
+	pollWatch(acc, state)
+}
 
-		// Parse Body if enabled
-		bodyText := ""
-		if msgLenght > 0 {
-			if r := msg.GetBody(section); r != nil {
-				mr, err := mail.CreateReader(r)
-				if err == nil {
-					for {
-						p, err := mr.NextPart()
-						if err == io.EOF {
-							break
-						}
-						if err != nil {
-							break
-						}
-						switch h := p.Header.(type) {
-						case *mail.InlineHeader:
-							contentType, _, _ := h.ContentType()
-							if contentType == "text/plain" {
-								b, _ := io.ReadAll(p.Body)
-								bodyText = string(b)
-							}
-						}
-					}
-				}
+// pollWatch checks for new mail every interval over one persistent connection,
+// using NOOP to keep it alive and reconnecting only when it fails
+func pollWatch(acc account, state *uidStore) {
+	r := currentRules()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	var c *client.Client
+	for {
+		if c != nil {
+			if err := c.Noop(); err != nil {
+				slog.Warn("connection lost", "account", acc.user, "err", err)
+				pollErrors.Add(1)
+				connFailed(acc, err)
+				c.Logout()
+				c = nil
 			}
+		}
+		if c == nil {
+			c, _ = openMailbox(acc)
+		}
+		if c != nil {
+			if err := fetchEmails(c, acc, scanDepth, state); err != nil {
+				// Reconnect on the next round
+				c.Logout()
+				c = nil
+			} else if unreadSummary {
+				checkUnread(c, acc)
+			}
+		}
+		checkIn(acc.key)
 
-			bodyText = truncateBody(bodyText, msgLenght)
+		select {
+		case <-ticker.C:
+		case <-r.replaced:
+			r = currentRules()
+			ticker.Reset(r.interval)
+		case <-shutdown:
+			if c != nil {
+				c.Logout()
+			}
+			return
 		}
+	}
+}
 
-		fmt.Printf("─────────────────────────────────────────\n")
-		fmt.Printf("From: %s\nDate: %s\nSubject: %s\n\n%s\n", sender, date, subject, bodyText)
-		sendNotification(sender, subject, bodyText)
+// parsePatterns compiles comma-separated address patterns into case-insensitive
+// regexps, where * matches any run of characters
+func parsePatterns(list string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		expr := strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*")
+		patterns = append(patterns, regexp.MustCompile("(?i)^"+expr+"$"))
 	}
+	return patterns
+}
+
+// senderAllowed reports whether sender passes the allow and block lists
+func senderAllowed(sender string) bool {
+	r := currentRules()
+	for _, p := range r.blockPatterns {
+		if p.MatchString(sender) {
+			return false
+		}
+	}
+	if len(r.allowPatterns) == 0 {
+		return true
+	}
+	for _, p := range r.allowPatterns {
+		if p.MatchString(sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// urgentMail reports whether m matches -urgent-from or -urgent-subject
+func urgentMail(m newMail) bool {
+	r := currentRules()
+	for _, p := range r.urgentPatterns {
+		if p.MatchString(m.sender) {
+			return true
+		}
+	}
+	return r.urgentSubject != nil && r.urgentSubject.MatchString(m.subject)
+}
+
+// Notifier delivers a desktop notification
+type Notifier interface {
+	Send(n notification) error
+}
+
+// notification is what a Notifier shows
+// link, if not empty, is opened when the notification is clicked
+// thread, if not empty, lists the Message-IDs a Snooze action would silence,
+// notifiers without action buttons ignore it
+// icon is a themed icon name or image path, -icon when empty
+// urgent asks for critical urgency, notifiers without urgency levels ignore it
+// messageID and replyTo group a thread: a notification still showing for
+// replyTo is replaced rather than stacked, where the notifier can
+// event is the email in the -read -json shape, nil for summaries and notices
+type notification struct {
+	title     string
+	subject   string
+	body      string
+	link      string
+	icon      string
+	thread    []string
+	urgent    bool
+	messageID string
+	replyTo   string
+	event     *email
+}
+
+// notifier is the platform notifier, see newNotifier in notify_*.go
+// Replace it to capture notifications instead of showing them
+var notifier Notifier = retryNotifier{newNotifier()}
+
+// notifyAttempts is how often a notification is tried before giving up, so one
+// sent while the notification daemon is still starting isn't lost
+const notifyAttempts = 3
+
+// retryNotifier retries failed sends with a short backoff (1s, 2s)
+type retryNotifier struct {
+	Notifier
+}
+
+func (r retryNotifier) Send(n notification) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := r.Notifier.Send(n)
+		if err == nil || attempt == notifyAttempts {
+			return err
+		}
+		slog.Debug("notification failed, retrying", "attempt", attempt, "retry_in", delay, "err", err)
+		if !sleep(delay) {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// multiNotifier sends to each of its notifiers, succeeding if any of them did
+type multiNotifier []Notifier
+
+func (m multiNotifier) Send(n notification) error {
+	var errs []error
+	for _, notifier := range m {
+		if err := notifier.Send(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(m) {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		slog.Warn("notification failed", "err", err)
+	}
+	return nil
+}
+
+func sendNotification(user string, m newMail) error {
+	n := notification{
+		title:     fmt.Sprintf("From: %s", m.sender) + accountLabel(user),
+		subject:   m.subject,
+		body:      cmp.Or(m.snippet, m.body),
+		link:      gmailLink(user, m.messageID),
+		icon:      senderIcon(m.sender),
+		thread:    slices.DeleteFunc([]string{m.messageID, m.inReplyTo}, func(id string) bool { return id == "" }),
+		urgent:    urgentMail(m),
+		messageID: m.messageID,
+		replyTo:   m.inReplyTo,
+	}
+	// Webhooks get the message itself, not what templates made of it
+	e := mailEvent(user, m)
+	n.event = &e
+	if summaryTmpl != nil {
+		if title, ok := renderTemplate(summaryTmpl, user, m); ok {
+			n.title = title
+		}
+	}
+	if m.recipients != "" {
+		n.body = strings.TrimSpace(m.recipients + "\n\n" + n.body)
+	}
+	if bodyTmpl != nil {
+		// The template replaces the subject line notifiers put above the body
+		if body, ok := renderTemplate(bodyTmpl, user, m); ok {
+			n.subject, n.body = "", body
+		}
+	}
+	return notifier.Send(n)
+}
+
+// checkUnread notifies with the mailbox's unread count when it changed since the last check
+func checkUnread(c *client.Client, acc account) {
+	user := acc.user
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	seqNums, err := search(c, criteria, false)
+	if err != nil {
+		slog.Error("unread search failed", "account", user, "err", err)
+		return
+	}
+
+	unreadMu.Lock()
+	last, seen := lastUnread[acc.key]
+	lastUnread[acc.key] = len(seqNums)
+	unreadMu.Unlock()
+
+	if (seen && last == len(seqNums)) || inQuietHours(time.Now()) {
+		return
+	}
+
+	subject := fmt.Sprintf("You have %d unread messages", len(seqNums))
+	if len(seqNums) == 1 {
+		subject = "You have 1 unread message"
+	}
+	if multiMailbox() {
+		subject += " in " + acc.mailbox
+	}
+	if err := notifier.Send(notification{title: user, subject: subject, link: inboxLink(user)}); err != nil {
+		slog.Error("notification failed", "account", user, "err", err)
+		return
+	}
+	slog.Info("unread summary sent", "account", user, "unread", len(seqNums))
+}
+
+// inboxLink returns a Gmail web UI link to the account's inbox
+// Empty for non-Gmail servers
+func inboxLink(user string) string {
+	if imapHost != defaultIMAPHost {
+		return ""
+	}
+	return fmt.Sprintf("https://mail.google.com/mail/u/%s/#inbox", url.PathEscape(user))
+}
+
+// gmailLink returns a Gmail web UI link to the message with the given Message-ID
+// Empty for non-Gmail servers
+func gmailLink(user, messageID string) string {
+	messageID = strings.Trim(messageID, "<>")
+	if messageID == "" || imapHost != defaultIMAPHost {
+		return ""
+	}
+	return fmt.Sprintf("https://mail.google.com/mail/u/%s/#search/rfc822msgid:%s",
+		url.PathEscape(user), url.QueryEscape(messageID))
+}
+
+// accountLabel returns a suffix naming the receiving account
+// Empty when only one account is watched
+func accountLabel(user string) string {
+	if !multiAccount() {
+		return ""
+	}
+	return fmt.Sprintf(" (to %s)", user)
+}
+
+// connectWithRetry dials Gmail and logs in, retrying with exponential backoff
+// (1s, 2s, 4s... capped at maxBackoff) up to maxConnectAttempts times
+func connectWithRetry(acc account) (*client.Client, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		c, err := connect(acc)
+		if err == nil {
+			connRestored(acc)
+			return c, nil
+		}
+		connectionFailures.Add(1)
+		connFailed(acc, err)
+		checkIn(acc.key)
+		if attempt == maxConnectAttempts {
+			slog.Error("giving up connecting", "account", acc.user, "attempts", attempt, "err", err)
+			return nil, err
+		}
+
+		slog.Warn("connection attempt failed", "account", acc.user, "attempt", attempt, "retry_in", backoff, "err", err)
+		if !sleep(backoff) {
+			return nil, errShutdown
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// newTLSConfig builds the TLS config for the IMAP server, trusting the PEM
+// certificates in caFile in addition to the system roots when set
+func newTLSConfig(caFile string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: imapHost, InsecureSkipVerify: skipVerify}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA certificate: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// connect dials Gmail and logs in once
+func connect(acc account) (*client.Client, error) {
+	slog.Debug("connecting", "account", acc.user)
+	c, dc, err := dialIMAP()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := login(c, acc); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	slog.Debug("logged in", "account", acc.user)
+	if dc != nil {
+		startCompression(c, dc, acc.user)
+	}
+	return c, nil
+}
+
+// dialIMAP opens an unauthenticated connection to the server, it can be
+// swapped for one to an in-memory server. The deflateConn is set with -compress
+var dialIMAP = dialServer
+
+// dialServer connects to -imap-host over TLS or STARTTLS
+func dialServer() (*client.Client, *deflateConn, error) {
+	addr := net.JoinHostPort(imapHost, strconv.Itoa(imapPort))
+
+	var c *client.Client
+	var err error
+	if compress {
+		c, dc, err := dialDeflate(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.Timeout = timeout
+		return c, dc, nil
+	}
+	if startTLS {
+		// Plaintext connection upgraded before credentials are sent
+		if c, err = client.DialWithDialer(imapDialer, addr); err != nil {
+			return nil, nil, err
+		}
+		c.Timeout = timeout
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, nil, fmt.Errorf("starttls: %w", err)
+		}
+	} else if c, err = client.DialWithDialerTLS(imapDialer, addr, tlsConfig); err != nil {
+		return nil, nil, err
+	}
+	c.Timeout = timeout
+	return c, nil, nil
+}
+
+// login authenticates with the account's OAuth2 token if set, app password otherwise
+func login(c *client.Client, acc account) error {
+	if acc.token == "" {
+		return c.Login(acc.user, acc.pass)
+	}
+
+	if err := c.Authenticate(&xoauth2Client{user: acc.user, token: acc.token}); err != nil {
+		slog.Error("OAuth token rejected, access tokens expire after about an hour, refresh it and restart", "account", acc.user, "err", err)
+		return err
+	}
+	return nil
+}
+
+// xoauth2Client implements the SASL XOAUTH2 mechanism used by Gmail
+type xoauth2Client struct {
+	user  string
+	token string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+// Next answers the server's JSON error challenge with an empty response,
+// after which the server fails the authentication
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// readEmails fetches emails from Gmail
+// count: number of emails to fetch
+// state: if not nil, only process emails newer than its UID and update it
+func readEmails(acc account, count int, state *uidStore) {
+	c, err := openMailbox(acc)
+	if err != nil {
+		return
+	}
+	defer c.Logout()
+
+	fetchEmails(c, acc, count, state)
+}
+
+// openMailbox connects and selects the watched mailbox
+func openMailbox(acc account) (*client.Client, error) {
+	c, err := connectWithRetry(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox, err := c.Select(acc.mailbox, false)
+	if err != nil {
+		slog.Error("select failed", "account", acc.user, "mailbox", acc.mailbox, "err", err)
+		c.Logout()
+		return nil, err
+	}
+	slog.Debug("selected mailbox", "account", acc.user, "mailbox", acc.mailbox, "messages", mbox.Messages)
+	return c, nil
+}
+
+// idleWatch keeps one connection open and waits for new mail using IMAP IDLE
+// Reconnects when the connection drops, returns errIdleUnsupported if the
+// server rejects IDLE so the caller can fall back to polling
+func idleWatch(acc account, state *uidStore) error {
+	for {
+		err := idleSession(acc, state)
+		if err == errIdleUnsupported {
+			slog.Info("IDLE not supported, falling back to polling", "account", acc.user, "interval", currentRules().interval)
+			return err
+		}
+		if err == errShutdown {
+			return err
+		}
+		slog.Warn("idle connection lost", "account", acc.user, "err", err)
+		pollErrors.Add(1)
+		connFailed(acc, err)
+		checkIn(acc.key)
+		if !sleep(15 * time.Second) {
+			return errShutdown
+		}
+	}
+}
+
+// idleSession runs a single IDLE connection until it fails
+func idleSession(acc account, state *uidStore) error {
+	c, err := connectWithRetry(acc)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	if ok, err := c.Support("IDLE"); err != nil {
+		return err
+	} else if !ok {
+		return errIdleUnsupported
+	}
+
+	mbox, err := c.Select(acc.mailbox, false)
+	if err != nil {
+		return fmt.Errorf("select %s: %w", acc.mailbox, err)
+	}
+	slog.Debug("selected mailbox", "account", acc.user, "mailbox", acc.mailbox, "messages", mbox.Messages)
+
+	if err := fetchEmails(c, acc, scanDepth, state); err != nil {
+		return err
+	}
+	checkIn(acc.key)
+	if unreadSummary {
+		checkUnread(c, acc)
+	}
+
+	// Updates must be drained continuously, a blocked channel blocks the client
+	updates := make(chan client.Update, 10)
+	newMail := make(chan struct{}, 1)
+	c.Updates = updates
+	go func() {
+		for {
+			select {
+			case u := <-updates:
+				// Flag changes and expunges only matter for the unread count
+				switch u.(type) {
+				case *client.MessageUpdate, *client.ExpungeUpdate:
+					if !unreadSummary {
+						continue
+					}
+				case *client.MailboxUpdate:
+				default:
+					continue
+				}
+				select {
+				case newMail <- struct{}{}:
+				default:
+				}
+			case <-c.LoggedOut():
+				return
+			}
+		}
+	}()
+
+	for {
+		// IDLE waits on the server indefinitely, dead connections are caught
+		// by TCP keep-alives instead of the command timeout
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		c.Timeout = 0
+		go func() {
+			done <- c.Idle(stop, nil)
+		}()
+
+		select {
+		case <-newMail:
+		case <-time.After(idleCheckInterval):
+			// Nothing happened for a while, check the connection still works
+		case <-shutdown:
+			// IDLE must end with DONE before the deferred LOGOUT
+			close(stop)
+			<-done
+			return errShutdown
+		case err := <-done:
+			if err == nil {
+				err = errors.New("idle stopped unexpectedly")
+			}
+			return err
+		}
+		close(stop)
+		if err := <-done; err != nil {
+			return err
+		}
+		c.Timeout = timeout
+
+		// The message count can't tell what's new, go-imap doesn't lower it on
+		// EXPUNGE, so look for UIDs past the stored one instead
+		if c.Mailbox() == nil {
+			return errors.New("mailbox closed by server")
+		}
+		if err := fetchEmails(c, acc, scanDepth, state); err != nil {
+			return err
+		}
+		checkIn(acc.key)
+		if unreadSummary {
+			checkUnread(c, acc)
+		}
+	}
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inQuietHours reports whether t falls in the -quiet-start/-quiet-end window,
+// which may cross midnight (e.g. 22:00-07:00)
+func inQuietHours(t time.Time) bool {
+	r := currentRules()
+	if r.quietStartMin == r.quietEndMin {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if r.quietStartMin < r.quietEndMin {
+		return now >= r.quietStartMin && now < r.quietEndMin
+	}
+	return now >= r.quietStartMin || now < r.quietEndMin
+}
+
+// newMail is a message waiting to be notified
+type newMail struct {
+	uid       uint32
+	sender    string
+	subject   string
+	body      string
+	date      time.Time
+	messageID string
+	inReplyTo string
+
+	// recipients are the -show-to, -show-cc and -show-labels lines, if any
+	recipients string
+
+	// snippet replaces body in notifications with -snippet-length
+	snippet string
+
+	// acc is the IMAP account and mailbox the message is in, for -mark-read
+	// once a held back notification goes out
+	acc account
+}
+
+// handleMessage filters and prints a fetched message, or collects it for -json
+// When watching, it returns the message to notify about unless it was already
+// notified or its thread is snoozed. body is the raw message, nil if not fetched
+// labels are its Gmail labels for -show-labels, nil if not fetched
+func handleMessage(user string, uid uint32, env *imap.Envelope, labels []string, body io.Reader, watching bool) (newMail, bool) {
+	// Spam and bounces may arrive without an envelope or From header
+	if env == nil {
+		env = &imap.Envelope{}
+	}
+
+	sender := senderAddress(env)
+	if !senderAllowed(sender) {
+		slog.Debug("skipped message", "account", user, "uid", uid, "reason", "sender filtered", "from", sender)
+		return newMail{}, false
+	}
+	if automatedSender(sender) {
+		slog.Debug("skipped message", "account", user, "uid", uid, "reason", "automated sender", "from", sender)
+		return newMail{}, false
+	}
+	subject := env.Subject
+	if re := currentRules().subjectFilter; re != nil && !re.MatchString(subject) {
+		slog.Debug("skipped message", "account", user, "uid", uid, "reason", "subject filtered", "subject", subject)
+		return newMail{}, false
+	}
+	date := env.Date.Format("2006-01-02 15:04")
+
+	// Parse Body if enabled
+	bodyText, snippet := "", ""
+	if fetchBody() && body != nil {
+		text, attachments := messageText(body)
+		if msgLenght > 0 {
+			bodyText = formatBody(text, attachments, msgLenght)
+		}
+		if snippetLength > 0 {
+			snippet = makeSnippet(text, snippetLength)
+		}
+	}
+
+	if jsonOutput {
+		e := email{
+			From:    sender,
+			Date:    env.Date.Format(time.RFC3339),
+			Subject: subject,
+			Body:    bodyText,
+			UID:     uid,
+		}
+		if multiAccount() {
+			e.Account = user
+		}
+		jsonEmails = append(jsonEmails, e)
+		return newMail{}, false
+	}
+
+	outputMu.Lock()
+	fmt.Printf("─────────────────────────────────────────\n")
+	if watching {
+		// When it was picked up, to compare with Date for delivery latency
+		fmt.Printf("%s New mail:\n", paint(ansiGray, time.Now().Format("[2006-01-02 15:04:05]")))
+	}
+	if multiAccount() {
+		fmt.Printf("Account: %s\n", user)
+	}
+	recipients := recipientLines(env, labels)
+	fmt.Print(formatMessage(paint(ansiCyan, sender), recipients, paint(ansiGray, date), paint(ansiBold, subject), bodyText))
+	outputMu.Unlock()
+
+	if !watching {
+		return newMail{}, false
+	}
+	if cutoff := sinceCutoff(); !env.Date.IsZero() && env.Date.Before(cutoff) {
+		slog.Debug("skipped message", "account", user, "uid", uid, "reason", "older than -since", "date", env.Date)
+		return newMail{}, false
+	}
+	if threadSnoozed(env.MessageId, env.InReplyTo) {
+		slog.Debug("skipped message", "account", user, "uid", uid, "reason", "thread snoozed", "message_id", env.MessageId)
+		return newMail{}, false
+	}
+	// Claimed rather than looked up, so when the watchers of two mailboxes get
+	// the same message at once only one notifies. Dry runs don't claim, the
+	// same messages trigger again on the next check
+	if seen := seenFor(user); dryRun && seen.has(env.MessageId) || !dryRun && !seen.claim(env.MessageId) {
+		slog.Debug("skipped message", "account", user, "uid", uid, "reason", "already notified", "message_id", env.MessageId)
+		return newMail{}, false
+	}
+	return newMail{
+		uid:        uid,
+		sender:     sender,
+		subject:    subject,
+		body:       bodyText,
+		snippet:    snippet,
+		date:       env.Date,
+		messageID:  env.MessageId,
+		inReplyTo:  env.InReplyTo,
+		recipients: strings.Join(recipients, "\n"),
+	}, true
+}
+
+// formatMessage lays out a message as printed to stdout: From, the -show-to
+// and -show-cc lines, Date and Subject, then the body after a blank line.
+// The body is expected to be cut to -length already, see formatBody
+func formatMessage(from string, recipients []string, date, subject, body string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\n", from)
+	for _, line := range recipients {
+		b.WriteString(line + "\n")
+	}
+	fmt.Fprintf(&b, "Date: %s\nSubject: %s\n\n%s\n", date, subject, body)
+	return b.String()
+}
+
+// sinceCutoff returns the date before which mail isn't notified, zero
+// without -since. A relative -since like 24h moves along with the clock
+func sinceCutoff() time.Time {
+	if sinceAge > 0 {
+		return time.Now().Add(-sinceAge)
+	}
+	return sinceTime
+}
+
+// parseSinceFlag reads -since as an RFC 3339 time or a duration back from now
+func parseSinceFlag(value string) error {
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		sinceAge = d
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid -since %q, use an RFC 3339 time like 2024-01-02T15:04:05Z or a duration like 24h", value)
+	}
+	sinceTime = t
+	return nil
+}
+
+// recipientLines returns "To: ...", "Cc: ..." and "Labels: ..." lines for
+// -show-to, -show-cc and -show-labels, leaving out empty lists
+func recipientLines(env *imap.Envelope, labels []string) []string {
+	var lines []string
+	if showTo && len(env.To) > 0 {
+		lines = append(lines, "To: "+addressList(env.To))
+	}
+	if showCc && len(env.Cc) > 0 {
+		lines = append(lines, "Cc: "+addressList(env.Cc))
+	}
+	if showLabels && len(labels) > 0 {
+		lines = append(lines, "Labels: "+strings.Join(labels, ", "))
+	}
+	return lines
+}
+
+// addressList joins envelope addresses, skipping empty ones like group markers
+func addressList(addrs []*imap.Address) string {
+	var list []string
+	for _, a := range addrs {
+		if a == nil {
+			continue
+		}
+		if addr := a.Address(); addr != "@" {
+			list = append(list, addr)
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// markNotified saves the Message-IDs handleMessage claimed for notified
+// messages, so they aren't notified again, e.g. when the same message shows up
+// under a new UID or after a restart
+func markNotified(user string, pending []newMail) {
+	if len(pending) == 0 || dryRun {
+		return
+	}
+	seenFor(user).save(user)
+}
+
+// notifyAll sends a notification per message, or a single summary when more
+// than coalesce messages arrived at once
+func notifyAll(c *client.Client, user string, pending []newMail) {
+	if len(pending) == 0 {
+		return
+	}
+	runExec(user, pending)
+	publishEvents(user, pending)
+	if tailMode {
+		// Already printed by handleMessage
+		return
+	}
+	if inQuietHours(time.Now()) {
+		slog.Debug("notifications suppressed by quiet hours", "account", user, "count", len(pending))
+		return
+	}
+
+	if notifyAllowed() {
+		markDelivered(c, deliver(user, pending))
+	} else {
+		// Sent by runDeferred once -notify-when allows
+		deferNotifications(user, pending)
+	}
+}
+
+// deliver notifies about pending per -digest, -coalesce and -max-per-minute,
+// returning the messages a notification went out for. Messages queued for
+// -digest aren't among them until flushDigest sends them
+func deliver(user string, pending []newMail) (sent []newMail) {
+	if digestInterval > 0 {
+		// Sent by runDigest every -digest instead
+		queueDigest(user, pending)
+	} else if coalesce > 0 && len(pending) > coalesce {
+		if sendSummary(user, fmt.Sprintf("%d new messages", len(pending)), pending) {
+			sent = pending
+		}
+	} else {
+		var limited []newMail
+		for _, m := range pending {
+			if !notifyLimiter.allow() {
+				limited = append(limited, m)
+				continue
+			}
+			if err := sendNotification(user, m); err != nil {
+				slog.Error("notification failed", "account", user, "uid", m.uid, "err", err)
+				continue
+			}
+			slog.Info("notification sent", "account", user, "uid", m.uid, "from", m.sender)
+			messagesNotified.Add(1)
+			sent = append(sent, m)
+		}
+
+		// Over -max-per-minute, the rest go out as one summary
+		if len(limited) > 0 {
+			slog.Info("notification rate limit reached", "account", user, "held_back", len(limited))
+			if sendSummary(user, fmt.Sprintf("…and %d more new messages", len(limited)), limited) {
+				sent = append(sent, limited...)
+			}
+		}
+	}
+	return sent
+}
+
+// markDelivered records messages whose notification went out in
+// -history-file and marks them read for -mark-read. c is the connection they
+// were fetched on, or nil for held back messages, which get a connection per
+// mailbox
+func markDelivered(c *client.Client, msgs []newMail) {
+	for _, m := range msgs {
+		appendHistory(m)
+	}
+	if !markRead || dryRun || len(msgs) == 0 {
+		return
+	}
+	if c != nil {
+		for _, m := range msgs {
+			markSeen(c, m.acc.user, m.uid)
+		}
+		return
+	}
+
+	byMailbox := map[string][]newMail{}
+	for _, m := range msgs {
+		byMailbox[m.acc.key] = append(byMailbox[m.acc.key], m)
+	}
+	for _, msgs := range byMailbox {
+		c, err := openMailbox(msgs[0].acc)
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			markSeen(c, m.acc.user, m.uid)
+		}
+		c.Logout()
+	}
+}
+
+// sendSummary sends one notification standing in for msgs, naming the latest,
+// and reports whether it went out
+func sendSummary(user, title string, msgs []newMail) bool {
+	latest := msgs[len(msgs)-1]
+	err := notifier.Send(notification{
+		title:   title + accountLabel(user),
+		subject: fmt.Sprintf("Latest from %s: %s", latest.sender, latest.subject),
+		link:    inboxLink(user),
+	})
+	if err != nil {
+		slog.Error("notification failed", "account", user, "count", len(msgs), "err", err)
+		return false
+	}
+	slog.Info("summary notification sent", "account", user, "count", len(msgs))
+	messagesNotified.Add(int64(len(msgs)))
+	return true
+}
+
+// appendHistory adds a tab-separated line (time, from, subject, first body line)
+// for a notified message to -history-file
+func appendHistory(m newMail) {
+	if historyFile == "" {
+		return
+	}
+
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(m.body), "\n")
+	clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	line := strings.Join([]string{
+		time.Now().Format("2006-01-02 15:04:05"),
+		clean.Replace(m.sender),
+		clean.Replace(m.subject),
+		clean.Replace(firstLine),
+	}, "\t") + "\n"
+
+	f, err := os.OpenFile(historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("writing history failed", "file", historyFile, "err", err)
+		return
+	}
+	defer f.Close()
+	f.WriteString(line)
+}
+
+// markSeen adds the \Seen flag to the message with the given UID
+func markSeen(c *client.Client, user string, uid uint32) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(seqset, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+		slog.Error("marking message read failed", "account", user, "uid", uid, "err", err)
+	}
+}
+
+// senderAddress returns the first From address, or "(unknown sender)" if there is none
+func senderAddress(env *imap.Envelope) string {
+	if len(env.From) == 0 || env.From[0] == nil {
+		return "(unknown sender)"
+	}
+	if addr := env.From[0].Address(); addr != "@" {
+		return addr
+	}
+	return "(unknown sender)"
+}
+
+// fetchBody reports whether message bodies are needed, for -length or -snippet-length
+func fetchBody() bool {
+	return msgLenght > 0 || snippetLength > 0
+}
+
+// fetchItems returns the items to fetch for each message and the body
+// section among them: Envelope, UID, and optionally Body (Peek=true to not mark as read)
+func fetchItems() (*imap.BodySectionName, []imap.FetchItem) {
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
+	if fetchBody() {
+		items = append(items, section.FetchItem())
+	}
+	if headersOnly {
+		// Just the headers notifications use, smaller than a full ENVELOPE
+		section = &imap.BodySectionName{Peek: true, BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{"From", "To", "Cc", "Subject", "Date", "Message-Id", "In-Reply-To"},
+		}}
+		items = []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+	}
+	if showLabels {
+		items = append(items, fetchLabels)
+	}
+	return section, items
+}
+
+// messageParts returns a fetched message's envelope and body, parsing the
+// envelope from the fetched headers with -headers-only
+func messageParts(msg *imap.Message, section *imap.BodySectionName) (*imap.Envelope, io.Reader) {
+	env, body := msg.Envelope, io.Reader(msg.GetBody(section))
+	if headersOnly {
+		if body != nil {
+			header, _ := io.ReadAll(body)
+			env = parseEnvelope(header)
+		}
+		body = nil
+	}
+	return env, body
+}
+
+// fetchEmails fetches the last count emails from the selected mailbox
+// state: if not nil, only process emails newer than its UID and update it
+// Returns search and fetch errors, which usually mean the connection is gone
+func fetchEmails(c *client.Client, acc account, count int, state *uidStore) error {
+	user := acc.user
+	mbox := c.Mailbox()
+	if mbox == nil {
+		pollErrors.Add(1)
+		return errors.New("no mailbox selected")
+	}
+	if mbox.Messages == 0 {
+		markPolled()
+		return nil
+	}
+
+	var lastUID uint32
+	if state != nil {
+		state.checkValidity(user, mbox.UidValidity, mbox.UidNext)
+		lastUID = state.last()
+	}
+
+	// Notifications belong to the watch loop, -read only prints
+	msgs, err := checkNew(c, acc, imapSource{c: c, user: user, count: count}, lastUID, state != nil)
+	if err != nil {
+		return err
+	}
+	var maxUID uint32
+	for _, msg := range msgs {
+		maxUID = max(maxUID, msg.uid)
+	}
+
+	// In daemon mode, save the newest UID once all messages are processed
+	// Dry runs keep it so the same messages trigger again on the next check
+	if state != nil && !dryRun && state.advance(maxUID) {
+		// Only the newest -scan-depth messages are looked at on first run, say so
+		slog.Info("initialized state, watching for new mail", "account", user, "uid", maxUID)
+	}
+	return nil
+}
+
+// imapSource is the MailSource of an IMAP connection's selected mailbox.
+// Without a lastUID, it returns the last count messages
+type imapSource struct {
+	c     *client.Client
+	user  string
+	count int
+}
+
+func (s imapSource) FetchNew(lastUID uint32) ([]Message, error) {
+	c, user, count := s.c, s.user, s.count
+	mbox := c.Mailbox()
+	if mbox == nil {
+		pollErrors.Add(1)
+		return nil, errors.New("no mailbox selected")
+	}
+
+	section, items := fetchItems()
+	if onlyFlagged {
+		items = append(items, imap.FetchFlags)
+	}
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	seqset := new(imap.SeqSet)
+	if lastUID != 0 {
+		// Search by UID rather than sequence number, which shifts on expunge
+		criteria := imap.NewSearchCriteria()
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(lastUID+1, 0)
+		uids, err := search(c, criteria, true)
+		if err != nil {
+			slog.Error("search failed", "account", user, "err", err)
+			pollErrors.Add(1)
+			return nil, err
+		}
+		// "N:*" always matches the newest message, even if it's older than N,
+		// drop it rather than fetching it again on every check
+		uids = slices.DeleteFunc(uids, func(uid uint32) bool { return uid <= lastUID })
+		if len(uids) == 0 {
+			return nil, nil
+		}
+		seqset.AddNum(uids...)
+		go func() {
+			done <- c.UidFetch(seqset, items, messages)
+		}()
+	} else if len(gmSearchKeys()) > 0 {
+		// The last x emails in the category or label, which aren't the mailbox's last x
+		uids, err := search(c, imap.NewSearchCriteria(), true)
+		if err != nil {
+			slog.Error("search failed", "account", user, "err", err)
+			pollErrors.Add(1)
+			return nil, err
+		}
+		if len(uids) == 0 {
+			return nil, nil
+		}
+		slices.Sort(uids)
+		seqset.AddNum(uids[max(len(uids)-count, 0):]...)
+		go func() {
+			done <- c.UidFetch(seqset, items, messages)
+		}()
+	} else if mbox.Messages > 0 {
+		// Calculate range for last x emails
+		from := mbox.Messages
+		if uint32(count) < mbox.Messages {
+			from = mbox.Messages - uint32(count) + 1
+		}
+		seqset.AddRange(from, mbox.Messages)
+		go func() {
+			done <- c.Fetch(seqset, items, messages)
+		}()
+	} else {
+		return nil, nil
+	}
+
+	var msgs []Message
+	for msg := range messages {
+		env, body := messageParts(msg, section)
+		msgs = append(msgs, Message{uid: msg.Uid, env: env, labels: messageLabels(msg), flags: msg.Flags, body: body})
+	}
+	// The channel is closed on failure too, check why it ended
+	if err := <-done; err != nil {
+		slog.Error("fetch failed", "account", user, "err", err)
+		pollErrors.Add(1)
+		return nil, err
+	}
+	slog.Debug("fetched messages", "account", user, "count", len(msgs))
+
+	// Notify oldest first
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].uid < msgs[j].uid
+	})
+	return msgs, nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// fakeNotifier records notifications instead of showing them
+type fakeNotifier struct {
+	mu   sync.Mutex
+	sent []notification
+}
+
+func (f *fakeNotifier) Send(n notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, n)
+	return nil
+}
+
+// take returns the notifications sent so far and forgets them
+func (f *fakeNotifier) take() []notification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sent := f.sent
+	f.sent = nil
+	return sent
+}
+
+// setupTest sets the options main would, with state in a temporary
+// directory and notifications going to the returned fakeNotifier
+func setupTest(t *testing.T) *fakeNotifier {
+	t.Helper()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	interval, notifyWhen = 15*time.Second, "always"
+	r, err := buildRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRules(r)
+	seenByUser = map[string]*seenIDs{}
+
+	fake := &fakeNotifier{}
+	old := notifier
+	notifier = fake
+	t.Cleanup(func() { notifier = old })
+	return fake
+}
+
+// startIMAPServer serves go-imap's in-memory backend, whose user "username"
+// with password "password" has an INBOX holding one message, and points
+// dialIMAP at it. It returns the INBOX to add messages to
+func startIMAPServer(t *testing.T) backend.Mailbox {
+	t.Helper()
+	be := memory.New()
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	old := dialIMAP
+	dialIMAP = func() (*client.Client, *deflateConn, error) {
+		c, err := client.Dial(l.Addr().String())
+		return c, nil, err
+	}
+	t.Cleanup(func() { dialIMAP = old })
+
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox
+}
+
+// addMessage delivers a plain text message to mbox
+func addMessage(t *testing.T, mbox backend.Mailbox, subject, messageID string) {
+	t.Helper()
+	raw := fmt.Sprintf("From: Alice <alice@example.com>\r\nTo: username@example.com\r\nSubject: %s\r\n"+
+		"Message-ID: %s\r\nDate: Mon, 12 Oct 2026 10:00:00 +0000\r\n\r\nHello\r\n", subject, messageID)
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(raw)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollNotifiesNewMailOnce(t *testing.T) {
+	fake := setupTest(t)
+	mbox := startIMAPServer(t)
+	acc := account{user: "username", pass: "password", mailbox: "INBOX", key: "username"}
+	state := loadUID(acc.key)
+
+	// The first check starts from the newest message
+	readEmails(acc, 1, state)
+	first := state.last()
+	if first == 0 {
+		t.Fatal("first check didn't store a UID")
+	}
+	fake.take()
+
+	addMessage(t, mbox, "Lunch?", "<lunch@example.com>")
+	readEmails(acc, 1, state)
+	sent := fake.take()
+	if len(sent) != 1 {
+		t.Fatalf("got %d notifications for one new message, want 1: %+v", len(sent), sent)
+	}
+	if sent[0].subject != "Lunch?" || sent[0].title != "From: alice@example.com" {
+		t.Errorf("got notification %q / %q, want \"From: alice@example.com\" / \"Lunch?\"", sent[0].title, sent[0].subject)
+	}
+
+	uid := state.last()
+	if uid <= first {
+		t.Fatalf("UID didn't advance past %d, got %d", first, uid)
+	}
+	data, err := os.ReadFile(uidPath(acc.key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(string(data)); len(fields) == 0 || fields[0] != strconv.FormatUint(uint64(uid), 10) {
+		t.Errorf("UID file holds %q, want UID %d", data, uid)
+	}
+
+	// Nothing new, nothing to notify
+	readEmails(acc, 1, state)
+	if sent := fake.take(); len(sent) != 0 {
+		t.Errorf("got %d notifications without new mail, want 0: %+v", len(sent), sent)
+	}
+	if state.last() != uid {
+		t.Errorf("UID changed from %d to %d without new mail", uid, state.last())
+	}
+}
+
+func TestNotificationsForMessages(t *testing.T) {
+	fake := setupTest(t)
+	pending := []newMail{
+		{uid: 1, sender: "alice@example.com", subject: "Lunch?", body: "Noon at the usual place", messageID: "<lunch@example.com>"},
+		{uid: 2, sender: "bob@example.com", subject: "Re: Lunch?", body: "Count me in", messageID: "<re@example.com>", inReplyTo: "<lunch@example.com>"},
+		{uid: 3, sender: "carol@example.com", subject: "No Message-ID"},
+	}
+	want := []notification{
+		{title: "From: alice@example.com", subject: "Lunch?", body: "Noon at the usual place", thread: []string{"<lunch@example.com>"}},
+		{title: "From: bob@example.com", subject: "Re: Lunch?", body: "Count me in", thread: []string{"<re@example.com>", "<lunch@example.com>"}, replyTo: "<lunch@example.com>"},
+		{title: "From: carol@example.com", subject: "No Message-ID"},
+	}
+
+	notifyAll(nil, "username", pending)
+	sent := fake.take()
+	if len(sent) != len(want) {
+		t.Fatalf("got %d notifications, want %d: %+v", len(sent), len(want), sent)
+	}
+	for i, n := range sent {
+		w := want[i]
+		if n.title != w.title || n.subject != w.subject || n.body != w.body || n.replyTo != w.replyTo || !slices.Equal(n.thread, w.thread) {
+			t.Errorf("notification %d:\n got %+v\nwant %+v", i, n, w)
+		}
+	}
+
+	// Over -coalesce, one summary stands in for them all
+	coalesce = 2
+	t.Cleanup(func() { coalesce = 0 })
+	notifyAll(nil, "username", pending)
+	sent = fake.take()
+	if len(sent) != 1 {
+		t.Fatalf("got %d notifications over -coalesce, want 1: %+v", len(sent), sent)
+	}
+	if sent[0].title != "3 new messages" || sent[0].subject != "Latest from carol@example.com: No Message-ID" {
+		t.Errorf("got summary %q / %q", sent[0].title, sent[0].subject)
+	}
+}
+
+// TestFormatMessage covers the layout only, truncation is TestTruncateBody's
+func TestFormatMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		recipients []string
+		body       string
+		want       string
+	}{
+		{"headers then body", nil, "Noon?", "From: alice@example.com\nDate: 2026-10-12 10:00\nSubject: Lunch?\n\nNoon?\n"},
+		{"empty body", nil, "", "From: alice@example.com\nDate: 2026-10-12 10:00\nSubject: Lunch?\n\n\n"},
+		// -show-to and -show-cc lines go between From and Date
+		{"recipients", []string{"To: bob@example.com", "Cc: carol@example.com"}, "Noon?",
+			"From: alice@example.com\nTo: bob@example.com\nCc: carol@example.com\nDate: 2026-10-12 10:00\nSubject: Lunch?\n\nNoon?\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatMessage("alice@example.com", tt.recipients, "2026-10-12 10:00", "Lunch?", tt.body)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
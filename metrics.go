@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Counters exposed on -metrics-addr in the Prometheus text format
+var (
+	messagesNotified   atomic.Int64
+	pollErrors         atomic.Int64
+	connectionFailures atomic.Int64
+	lastPoll           atomic.Int64 // unix seconds
+)
+
+// serveMetrics starts the metrics HTTP server in the background
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetric(w, "gmail_messages_notified_total", "counter", "Messages a notification was sent for.", messagesNotified.Load())
+		writeMetric(w, "gmail_poll_errors_total", "counter", "Failed mailbox checks.", pollErrors.Load())
+		writeMetric(w, "gmail_connection_failures_total", "counter", "Failed connection or login attempts.", connectionFailures.Load())
+		writeMetric(w, "gmail_last_poll_timestamp", "gauge", "Unix time of the last successful mailbox check.", lastPoll.Load())
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// markPolled records a successful mailbox check
+func markPolled() {
+	lastPoll.Store(time.Now().Unix())
+	notifyReady()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"cmp"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// macNotifier uses terminal-notifier when installed, osascript otherwise
+type macNotifier struct {
+	terminalNotifier string
+}
+
+func newNotifier() Notifier {
+	path, _ := exec.LookPath("terminal-notifier")
+	return macNotifier{terminalNotifier: path}
+}
+
+func (n macNotifier) Send(msg notification) error {
+	if n.terminalNotifier != "" {
+		args := []string{
+			"-title", msg.title,
+			"-subtitle", msg.subject,
+			"-message", msg.body,
+			"-group", "gmail-notifications",
+		}
+		if msg.link != "" {
+			args = append(args, "-open", msg.link)
+		}
+		// Themed icon names only exist on Linux
+		if icon := cmp.Or(msg.icon, icon); strings.ContainsRune(icon, os.PathSeparator) {
+			args = append(args, "-appIcon", icon)
+		}
+		return exec.Command(n.terminalNotifier, args...).Run()
+	}
+
+	// osascript notifications can't open a link when clicked
+	// Pass values as arguments so they never need AppleScript escaping
+	return exec.Command("osascript",
+		"-e", "on run argv",
+		"-e", "display notification (item 3 of argv) with title (item 1 of argv) subtitle (item 2 of argv)",
+		"-e", "end run",
+		msg.title, msg.subject, msg.body,
+	).Run()
+}
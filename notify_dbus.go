@@ -0,0 +1,167 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/esiqveland/notify"
+	"github.com/godbus/dbus/v5"
+)
+
+// dbusNotifier sends freedesktop notifications over the session bus, reusing
+// one connection until it breaks
+// links maps notification IDs to the URL opened when they're clicked,
+// threads to the Message-IDs silenced by their Snooze action
+// shown maps the Message-IDs of open notifications to their ID, so replies
+// replace them
+type dbusNotifier struct {
+	mu       sync.Mutex
+	conn     *dbus.Conn
+	notifier notify.Notifier
+	links    map[uint32]string
+	threads  map[uint32][]string
+	shown    map[string]uint32
+}
+
+func newNotifier() Notifier {
+	return &dbusNotifier{links: map[uint32]string{}, threads: map[uint32][]string{}, shown: map[string]uint32{}}
+}
+
+// connect lazily creates the notifier so action signals have one listener
+func (n *dbusNotifier) connect() (notify.Notifier, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.notifier != nil {
+		return n.notifier, nil
+	}
+
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := notify.New(conn,
+		notify.WithOnAction(n.onAction),
+		notify.WithOnClosed(n.onClosed),
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.conn, n.notifier = conn, notifier
+	return notifier, nil
+}
+
+// dropBroken forgets the connection if the bus went away, e.g. after the
+// session bus restarted, so the next Send reconnects
+func (n *dbusNotifier) dropBroken() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil || n.conn.Connected() {
+		return
+	}
+	slog.Debug("D-Bus connection lost, reconnecting on next notification")
+	n.notifier.Close()
+	n.conn, n.notifier = nil, nil
+}
+
+func (n *dbusNotifier) Send(msg notification) error {
+	notifier, err := n.connect()
+	if err != nil {
+		return err
+	}
+
+	note := notify.Notification{
+		AppName:       "Gmail Notifications",
+		AppIcon:       cmp.Or(msg.icon, icon),
+		Summary:       msg.title,
+		Body:          msg.body,
+		ExpireTimeout: notifyTimeout, // 0 never expires
+	}
+	if msg.subject != "" {
+		note.Body = fmt.Sprintf("<b>%s</b>\n\n%s", msg.subject, msg.body)
+	}
+	if msg.link != "" {
+		note.Actions = append(note.Actions, notify.NewDefaultAction("Open in Gmail"))
+	}
+	if len(msg.thread) > 0 {
+		note.Actions = append(note.Actions, notify.Action{Key: "snooze", Label: "Snooze 1h"})
+	}
+	if sound != "" {
+		note.AddHint(soundHint(sound))
+	}
+	if msg.urgent {
+		note.SetUrgency(notify.UrgencyCritical)
+	}
+	if msg.replyTo != "" {
+		n.mu.Lock()
+		note.ReplacesID = n.shown[msg.replyTo]
+		n.mu.Unlock()
+	}
+
+	id, err := notifier.SendNotification(note)
+	if err != nil {
+		n.dropBroken()
+		return err
+	}
+
+	n.mu.Lock()
+	if msg.messageID != "" {
+		n.shown[msg.messageID] = id
+	}
+	if msg.link != "" {
+		n.links[id] = msg.link
+	}
+	if len(msg.thread) > 0 {
+		n.threads[id] = msg.thread
+	}
+	n.mu.Unlock()
+	return nil
+}
+
+// soundHint plays a sound file when given a path, a themed sound name otherwise
+func soundHint(sound string) notify.Hint {
+	if strings.ContainsRune(sound, os.PathSeparator) {
+		return notify.Hint{ID: "sound-file", Variant: dbus.MakeVariant(sound)}
+	}
+	return notify.HintSoundWithName(sound)
+}
+
+func (n *dbusNotifier) onAction(s *notify.ActionInvokedSignal) {
+	n.mu.Lock()
+	link, ok := n.links[s.ID]
+	thread := n.threads[s.ID]
+	n.mu.Unlock()
+
+	switch s.ActionKey {
+	case "default":
+		if ok {
+			_ = exec.Command("xdg-open", link).Start()
+		}
+	case "snooze":
+		if len(thread) == 0 {
+			return
+		}
+		snoozeThread(thread)
+		slog.Info("thread snoozed", "message_id", thread[0], "for", snoozeDuration)
+	}
+}
+
+func (n *dbusNotifier) onClosed(s *notify.NotificationClosedSignal) {
+	n.mu.Lock()
+	delete(n.links, s.ID)
+	delete(n.threads, s.ID)
+	for messageID, id := range n.shown {
+		if id == s.ID {
+			delete(n.shown, messageID)
+		}
+	}
+	n.mu.Unlock()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// toastScript shows a toast notification, reading its text from environment
+// variables so values never need PowerShell escaping
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText04)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:GMAIL_NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode($env:GMAIL_NOTIFY_SUBJECT)) > $null
+$text.Item(2).AppendChild($template.CreateTextNode($env:GMAIL_NOTIFY_BODY)) > $null
+if ($env:GMAIL_NOTIFY_LINK) {
+	$root = $template.GetElementsByTagName('toast').Item(0)
+	$root.SetAttribute('activationType', 'protocol')
+	$root.SetAttribute('launch', $env:GMAIL_NOTIFY_LINK)
+}
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('Gmail Notifications').Show($toast)
+`
+
+// toastNotifier shows Windows toast notifications via PowerShell
+type toastNotifier struct{}
+
+func newNotifier() Notifier {
+	return toastNotifier{}
+}
+
+func (toastNotifier) Send(msg notification) error {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(),
+		"GMAIL_NOTIFY_TITLE="+msg.title,
+		"GMAIL_NOTIFY_SUBJECT="+msg.subject,
+		"GMAIL_NOTIFY_BODY="+msg.body,
+		"GMAIL_NOTIFY_LINK="+msg.link,
+	)
+	return cmd.Run()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPOP3Port = 995
+
+// pop3Window is how many of the newest messages each POP3 poll looks at
+// It must stay below maxSeenIDs so known UIDLs aren't forgotten
+const pop3Window = maxSeenIDs / 2
+
+// pop3Conn is a minimal POP3 client (RFC 1939) with STLS and XOAUTH2
+type pop3Conn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// pop3Entry is a message number and its unique ID from UIDL
+type pop3Entry struct {
+	num int
+	id  string
+}
+
+// connectPOP3 dials -imap-host over TLS or STLS and logs in
+func connectPOP3(acc account) (*pop3Conn, error) {
+	slog.Debug("connecting", "account", acc.user, "protocol", "pop3")
+	addr := net.JoinHostPort(imapHost, strconv.Itoa(imapPort))
+	conn, err := imapDialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !startTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	p := &pop3Conn{conn: conn, text: textproto.NewConn(conn)}
+	if _, err := p.response(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("greeting: %w", err)
+	}
+
+	if startTLS {
+		// Plaintext connection upgraded before credentials are sent
+		if _, err := p.cmd("STLS"); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+		conn = tls.Client(conn, tlsConfig)
+		p = &pop3Conn{conn: conn, text: textproto.NewConn(conn)}
+	}
+
+	if err := p.login(acc); err != nil {
+		p.conn.Close()
+		return nil, err
+	}
+	slog.Debug("logged in", "account", acc.user, "protocol", "pop3")
+	return p, nil
+}
+
+// login authenticates with the account's OAuth2 token if set, app password otherwise
+func (p *pop3Conn) login(acc account) error {
+	if acc.token != "" {
+		ir := "user=" + acc.user + "\x01auth=Bearer " + acc.token + "\x01\x01"
+		_, err := p.cmd("AUTH XOAUTH2 %s", base64.StdEncoding.EncodeToString([]byte(ir)))
+		return err
+	}
+	if _, err := p.cmd("USER %s", acc.user); err != nil {
+		return err
+	}
+	_, err := p.cmd("PASS %s", acc.pass)
+	return err
+}
+
+// cmd sends a command and returns the text after +OK
+func (p *pop3Conn) cmd(format string, args ...any) (string, error) {
+	if timeout > 0 {
+		p.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := p.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return p.response()
+}
+
+// response reads a status line, turning -ERR into an error
+func (p *pop3Conn) response() (string, error) {
+	line, err := p.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if rest, ok := strings.CutPrefix(line, "+OK"); ok {
+		return strings.TrimSpace(rest), nil
+	}
+	return "", errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+}
+
+// uidl lists all messages in the maildrop, oldest first
+func (p *pop3Conn) uidl() ([]pop3Entry, error) {
+	if _, err := p.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := p.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []pop3Entry
+	for _, line := range lines {
+		num, id, ok := strings.Cut(line, " ")
+		n, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			continue
+		}
+		entries = append(entries, pop3Entry{num: n, id: id})
+	}
+	return entries, nil
+}
+
+// retrieve returns a whole message, or only its headers when the body is disabled
+func (p *pop3Conn) retrieve(num int) ([]byte, error) {
+	var err error
+	if fetchBody() {
+		_, err = p.cmd("RETR %d", num)
+	} else {
+		_, err = p.cmd("TOP %d 0", num)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.text.ReadDotBytes()
+}
+
+func (p *pop3Conn) quit() {
+	p.cmd("QUIT")
+	p.conn.Close()
+}
+
+// pop3Seen returns the cache of UIDLs already handled for an account
+// UIDLs share the Message-ID cache machinery under their own key
+func pop3Seen(user string) (*seenIDs, string) {
+	key := "pop3_" + user
+	return seenFor(key), key
+}
+
+// pop3Source is the MailSource of a POP3 session, new messages are the ones
+// whose UIDL isn't known yet. The first fetch only records what's already
+// there. POP3 has no UIDs, so lastUID is ignored
+type pop3Source struct {
+	p     *pop3Conn
+	user  string
+	known *seenIDs
+}
+
+func (s pop3Source) FetchNew(uint32) ([]Message, error) {
+	entries, err := s.p.uidl()
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[max(len(entries)-pop3Window, 0):]
+
+	// The cache file marks the first poll as done, even for an empty maildrop
+	if !s.known.initialized() {
+		for _, e := range entries {
+			s.known.add(e.id)
+		}
+		s.known.start()
+		slog.Info("initialized POP3 state, watching for new mail", "account", s.user, "messages", len(entries))
+		return nil, nil
+	}
+
+	var msgs []Message
+	for _, e := range entries {
+		if s.known.has(e.id) {
+			continue
+		}
+		raw, err := s.p.retrieve(e.num)
+		if err != nil {
+			// The ones fetched so far are still handled, the rest on the next poll
+			slog.Error("fetch failed", "account", s.user, "message", e.num, "err", err)
+			pollErrors.Add(1)
+			break
+		}
+		msgs = append(msgs, Message{uid: uint32(e.num), id: e.id, env: parseEnvelope(raw), body: bytes.NewReader(raw)})
+	}
+	return msgs, nil
+}
+
+// pollPOP3 opens a session and handles messages that arrived since the last poll
+// POP3 only shows mail that arrived before the session started, so each poll
+// uses a fresh connection
+func pollPOP3(acc account) {
+	p, err := connectPOP3(acc)
+	if err != nil {
+		slog.Error("connection failed", "account", acc.user, "err", err)
+		connectionFailures.Add(1)
+		connFailed(acc, err)
+		return
+	}
+	defer p.quit()
+
+	known, key := pop3Seen(acc.user)
+	first := !known.initialized()
+	msgs, err := checkNew(nil, acc, pop3Source{p: p, user: acc.user, known: known}, 0, true)
+	if err != nil {
+		slog.Error("listing messages failed", "account", acc.user, "err", err)
+		pollErrors.Add(1)
+		connFailed(acc, err)
+		return
+	}
+	connRestored(acc)
+
+	if (first || len(msgs) > 0) && !dryRun {
+		for _, msg := range msgs {
+			known.add(msg.id)
+		}
+		known.save(key)
+	}
+}
+
+// readPOP3 prints the last count messages, for -read
+func readPOP3(acc account, count int) {
+	p, err := connectPOP3(acc)
+	if err != nil {
+		slog.Error("connection failed", "account", acc.user, "err", err)
+		return
+	}
+	defer p.quit()
+
+	entries, err := p.uidl()
+	if err != nil {
+		slog.Error("listing messages failed", "account", acc.user, "err", err)
+		return
+	}
+	for _, e := range entries[max(len(entries)-count, 0):] {
+		raw, err := p.retrieve(e.num)
+		if err != nil {
+			slog.Error("fetch failed", "account", acc.user, "message", e.num, "err", err)
+			return
+		}
+		handleMessage(acc.user, uint32(e.num), parseEnvelope(raw), nil, bytes.NewReader(raw), false)
+	}
+}
+
+// pop3Watch polls a POP3 account every interval until shutdown is closed
+func pop3Watch(acc account) {
+	r := currentRules()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		pollPOP3(acc)
+		checkIn(acc.key)
+
+		select {
+		case <-ticker.C:
+		case <-r.replaced:
+			r = currentRules()
+			ticker.Reset(r.interval)
+		case <-shutdown:
+			return
+		}
+	}
+}
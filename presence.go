@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// idleAfter is how long without input counts as idle for -notify-when
+	idleAfter = 5 * time.Minute
+
+	// presenceCheckInterval is how often deferred notifications are retried
+	presenceCheckInterval = 30 * time.Second
+)
+
+var (
+	deferredByUser = map[string][]newMail{}
+	deferredMu     sync.Mutex
+)
+
+// notifyAllowed reports whether -notify-when lets notifications out now. If
+// the idle time can't be read it errs on the side of notifying
+func notifyAllowed() bool {
+	if notifyWhen == "always" {
+		return true
+	}
+	idle, err := sessionIdleTime()
+	if err != nil {
+		slog.Debug("reading idle time failed, notifying anyway", "err", err)
+		return true
+	}
+	return (idle >= idleAfter) == (notifyWhen == "idle")
+}
+
+// deferNotifications holds messages until -notify-when allows them
+func deferNotifications(user string, msgs []newMail) {
+	deferredMu.Lock()
+	defer deferredMu.Unlock()
+	deferredByUser[user] = append(deferredByUser[user], msgs...)
+	slog.Debug("notifications deferred", "account", user, "notify_when", notifyWhen, "count", len(msgs), "deferred", len(deferredByUser[user]))
+}
+
+// runDeferred delivers deferred messages once the session turns active or
+// idle as -notify-when asks, and on shutdown so nothing deferred is lost
+func runDeferred() {
+	ticker := time.NewTicker(presenceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !inQuietHours(time.Now()) && notifyAllowed() {
+				flushDeferred()
+			}
+		case <-shutdown:
+			flushDeferred()
+			return
+		}
+	}
+}
+
+// flushDeferred delivers and clears every account's deferred messages
+func flushDeferred() {
+	deferredMu.Lock()
+	deferred := deferredByUser
+	deferredByUser = map[string][]newMail{}
+	deferredMu.Unlock()
+
+	for user, msgs := range deferred {
+		slog.Info("delivering deferred notifications", "account", user, "count", len(msgs))
+		markDelivered(nil, deliver(user, msgs))
+	}
+}
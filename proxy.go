@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	// x/net/proxy only knows SOCKS5, add HTTP CONNECT proxies
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// newDialer returns the dialer used for IMAP connections, going through
+// proxyURL (socks5:// or http://) when set
+// A non-zero timeout bounds connecting, including the proxy and TLS handshakes
+func newDialer(proxyURL string, timeout time.Duration) (client.Dialer, error) {
+	d, err := proxyDialer(proxyURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return timeoutDialer{d, timeout}, nil
+}
+
+// proxyDialer returns a dialer going through proxyURL when set, with timeout
+// bounding only the TCP connect. It sets no deadline on the connection, so
+// HTTP clients can keep it alive across requests
+func proxyDialer(proxyURL string, timeout time.Duration) (proxy.Dialer, error) {
+	direct := &net.Dialer{Timeout: timeout}
+	if proxyURL == "" {
+		return direct, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.FromURL(u, direct)
+}
+
+// timeoutDialer sets a deadline on new connections covering everything up to
+// the first IMAP command, which replaces it with the client's Timeout
+type timeoutDialer struct {
+	forward proxy.Dialer
+	timeout time.Duration
+}
+
+func (d timeoutDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, addr)
+	if err != nil || d.timeout <= 0 {
+		return conn, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with CONNECT
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpConnectDialer{proxy: u, forward: forward}, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if d.proxy.Port() == "" {
+		host = net.JoinHostPort(host, "80")
+	}
+	conn, err := d.forward.Dial(network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := d.proxy.User; user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	// A plain text server's greeting can arrive with the response
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing perMinute events a minute, with
+// bursts of up to perMinute. Zero means unlimited
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	tokens    float64
+	last      time.Time
+}
+
+// notifyLimiter caps notifications across all watchers, see -max-per-minute
+var notifyLimiter = &rateLimiter{}
+
+// allow takes a token if one is available
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perMinute <= 0 {
+		return true
+	}
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(l.perMinute)
+	} else {
+		l.tokens = min(l.tokens+now.Sub(l.last).Minutes()*float64(l.perMinute), float64(l.perMinute))
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// parseSearch turns a -search query into IMAP search criteria. Terms are
+// ANDed: from:<addr>, subject:<text>, since:<YYYY-MM-DD or Nd>, unread, and
+// bare words matched anywhere in the message. Values with spaces can be quoted,
+// e.g. subject:"weekly report"
+func parseSearch(query string) (*imap.SearchCriteria, error) {
+	criteria := imap.NewSearchCriteria()
+	terms, err := splitQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+
+	for _, term := range terms {
+		key, value, ok := strings.Cut(term, ":")
+		if !ok {
+			if term == "unread" {
+				criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+			} else {
+				criteria.Text = append(criteria.Text, term)
+			}
+			continue
+		}
+		if value == "" {
+			return nil, fmt.Errorf("search term %q has no value", term)
+		}
+
+		switch key {
+		case "from":
+			criteria.Header.Add("From", value)
+		case "subject":
+			criteria.Header.Add("Subject", value)
+		case "since":
+			since, err := parseSince(value)
+			if err != nil {
+				return nil, err
+			}
+			criteria.Since = since
+		default:
+			return nil, fmt.Errorf("unknown search term %q, use from:, subject:, since: or unread", key+":")
+		}
+	}
+	return criteria, nil
+}
+
+// splitQuery splits a query on spaces, keeping double-quoted values together
+func splitQuery(query string) ([]string, error) {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in search query")
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+// parseSince reads a since: value, a date like 2024-01-02 or a number of
+// days back like 7d
+func parseSince(value string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since: %q, use YYYY-MM-DD or a number of days like 7d", value)
+	}
+	return t, nil
+}
+
+// searchEmails prints the messages in the watched mailbox matching criteria,
+// oldest first, for -search
+func searchEmails(acc account, criteria *imap.SearchCriteria) {
+	c, err := openMailbox(acc)
+	if err != nil {
+		return
+	}
+	defer c.Logout()
+
+	seqs, err := search(c, criteria, false)
+	if err != nil {
+		slog.Error("search failed", "account", acc.user, "err", err)
+		return
+	}
+	slog.Debug("search matched", "account", acc.user, "count", len(seqs))
+	if len(seqs) == 0 {
+		return
+	}
+
+	section, items := fetchItems()
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(seqs...)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seqset, items, messages)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range messages {
+		msgs = append(msgs, msg)
+	}
+	if err := <-done; err != nil {
+		slog.Error("fetch failed", "account", acc.user, "err", err)
+		return
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Uid < msgs[j].Uid
+	})
+	for _, msg := range msgs {
+		env, body := messageParts(msg, section)
+		handleMessage(acc.user, msg.Uid, env, messageLabels(msg), body, false)
+	}
+}
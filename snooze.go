@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// snoozeDuration is how long the Snooze action silences a thread
+const snoozeDuration = time.Hour
+
+// snoozed maps Message-IDs in snoozed threads to when the snooze ends
+var (
+	snoozed  = map[string]time.Time{}
+	snoozeMu sync.Mutex
+)
+
+// snoozeThread silences messages referring to any of ids for snoozeDuration
+func snoozeThread(ids []string) {
+	until := time.Now().Add(snoozeDuration)
+
+	snoozeMu.Lock()
+	defer snoozeMu.Unlock()
+	for _, id := range ids {
+		if id != "" {
+			snoozed[id] = until
+		}
+	}
+}
+
+// threadSnoozed reports whether a message is its own or a reply to a snoozed
+// message. Snoozed replies are added to the thread so replies to them are
+// caught too
+func threadSnoozed(messageID, inReplyTo string) bool {
+	now := time.Now()
+
+	snoozeMu.Lock()
+	defer snoozeMu.Unlock()
+	for id, until := range snoozed {
+		if now.After(until) {
+			delete(snoozed, id)
+		}
+	}
+
+	until, ok := snoozed[messageID]
+	if !ok && inReplyTo != "" {
+		until, ok = snoozed[inReplyTo]
+	}
+	if ok && messageID != "" {
+		snoozed[messageID] = until
+	}
+	return ok
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// socketWriteTimeout drops -socket clients that stop reading
+const socketWriteTimeout = 5 * time.Second
+
+var (
+	socketClients = map[net.Conn]bool{}
+	socketMu      sync.Mutex
+)
+
+// serveSocket listens on a Unix socket at path, so status bars and scripts
+// can follow new mail with e.g. `nc -U path`. The socket is removed on shutdown
+func serveSocket(path string) error {
+	// A socket left behind by a crashed run would make Listen fail
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	os.Chmod(path, 0600)
+
+	go func() {
+		<-shutdown
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			slog.Debug("socket client connected")
+			socketMu.Lock()
+			socketClients[conn] = true
+			socketMu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// publishEvents writes a JSON line per message to every -socket client, in
+// the same shape as -webhook
+func publishEvents(user string, pending []newMail) {
+	socketMu.Lock()
+	defer socketMu.Unlock()
+	if len(socketClients) == 0 {
+		return
+	}
+
+	for _, m := range pending {
+		line, err := json.Marshal(mailEvent(user, m))
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+		for conn := range socketClients {
+			conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			if _, err := conn.Write(line); err != nil {
+				slog.Debug("socket client gone", "err", err)
+				conn.Close()
+				delete(socketClients, conn)
+			}
+		}
+	}
+}
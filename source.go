@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// MailSource is where a watcher's new mail comes from: an IMAP mailbox, a
+// POP3 maildrop or the Gmail API. Each feeds its messages to checkNew
+type MailSource interface {
+	// FetchNew returns the messages that arrived after lastUID, oldest
+	// first. Sources without IMAP UIDs track what's new themselves and
+	// ignore it
+	FetchNew(lastUID uint32) ([]Message, error)
+}
+
+// Message is a message fetched by a MailSource
+// uid is the IMAP UID or POP3 message number, 0 for the Gmail API
+// id is the POP3 UIDL or the Gmail API message ID, empty for IMAP
+// body is the raw message, or nil if not fetched
+type Message struct {
+	uid    uint32
+	id     string
+	env    *imap.Envelope
+	labels []string
+	flags  []string
+	body   io.Reader
+}
+
+// checkNew fetches the messages src has after lastUID, filters and prints
+// them with handleMessage and, when watching, notifies about the ones that
+// pass. It returns every fetched message, for the caller to record as seen.
+// c is the IMAP connection for -mark-read, nil for other sources
+func checkNew(c *client.Client, acc account, src MailSource, lastUID uint32, watching bool) ([]Message, error) {
+	msgs, err := src.FetchNew(lastUID)
+	if err != nil {
+		return nil, err
+	}
+	markPolled()
+
+	var pending []newMail
+	for _, msg := range msgs {
+		if watching {
+			slog.Debug("new message", "account", acc.user, "uid", msg.uid)
+			if onlyFlagged && !slices.Contains(msg.flags, imap.FlaggedFlag) {
+				slog.Debug("skipped message", "account", acc.user, "uid", msg.uid, "reason", "not flagged")
+				continue
+			}
+		}
+		if m, ok := handleMessage(acc.user, msg.uid, msg.env, msg.labels, msg.body, watching); ok {
+			m.acc = acc
+			pending = append(pending, m)
+		}
+	}
+	notifyAll(c, acc.user, pending)
+	markNotified(acc.user, pending)
+	return msgs, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	uidFile     = ".gmail_last_uid.txt"
+	seenIDsFile = ".gmail_seen_ids.txt"
+)
+
+// maxSeenIDs is how many recent Message-IDs are remembered per account
+const maxSeenIDs = 200
+
+// uidPath returns the UID file used to track the given account
+func uidPath(user string) string {
+	return filepath.Join(stateDir(), strings.TrimSuffix(uidFile, ".txt")+"_"+user+".txt")
+}
+
+// stateDir returns $XDG_STATE_HOME/gmail-notifications, defaulting to
+// ~/.local/state/gmail-notifications, or the working directory if there's no home
+func stateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "gmail-notifications")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, ".local", "state", "gmail-notifications")
+}
+
+// uidStore is the last seen UID of a mailbox and the UIDVALIDITY it belongs
+// to, a UID is meaningless once UIDVALIDITY changes. mu guards reading,
+// updating and persisting them, so the store can be shared between goroutines
+type uidStore struct {
+	mu       sync.Mutex
+	uid      uint32
+	validity uint32
+
+	// key is the account.key the state is saved under
+	key string
+}
+
+// last returns the last seen UID, 0 before the first check
+func (s *uidStore) last() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uid
+}
+
+// checkValidity adopts the mailbox's UIDVALIDITY. When it changed, old UIDs
+// can't be compared anymore and the store restarts from the newest message
+func (s *uidStore) checkValidity(user string, validity, uidNext uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.validity == validity {
+		return
+	}
+	if s.validity != 0 {
+		slog.Warn("UIDVALIDITY changed, resetting to newest message", "account", user,
+			"old", s.validity, "new", validity)
+		s.uid = 0
+		if uidNext > 0 {
+			s.uid = uidNext - 1
+		}
+	}
+	s.validity = validity
+	if !dryRun {
+		s.persist()
+	}
+}
+
+// advance records uid as seen and saves it if it's newer than the last one.
+// It reports whether the store was still empty before
+func (s *uidStore) advance(uid uint32) (first bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uid <= s.uid {
+		return false
+	}
+	first = s.uid == 0
+	s.uid = uid
+	s.persist()
+	return first
+}
+
+// save writes the store to disk, unless nothing was seen yet
+func (s *uidStore) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.uid != 0 {
+		s.persist()
+	}
+}
+
+// persist writes "<uid> <uidvalidity>" to the mailbox's UID file, s.mu must be held
+func (s *uidStore) persist() {
+	data := strconv.FormatUint(uint64(s.uid), 10) + " " + strconv.FormatUint(uint64(s.validity), 10)
+	writeFileAtomic(uidPath(s.key), []byte(data))
+}
+
+// writeFileAtomic replaces path with data via a temp file in the same
+// directory, so a crash mid-write leaves the old file rather than a partial one
+func writeFileAtomic(path string, data []byte) error {
+	os.MkdirAll(filepath.Dir(path), 0700)
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadUID reads the mailbox's UID file, files without a UIDVALIDITY load
+// with validity 0 and adopt the mailbox's on the next check. An empty or
+// corrupt file starts fresh from the newest message, like a missing one
+func loadUID(key string) *uidStore {
+	state := &uidStore{key: key}
+	data, err := os.ReadFile(uidPath(key))
+	if err != nil {
+		return state
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		slog.Warn("UID file is empty, starting from the newest message", "state", key, "path", uidPath(key))
+		return state
+	}
+	uid, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		slog.Warn("UID file is corrupt, starting from the newest message", "state", key, "path", uidPath(key))
+		return state
+	}
+	state.uid = uint32(uid)
+	if len(fields) > 1 {
+		validity, _ := strconv.ParseUint(fields[1], 10, 32)
+		state.validity = uint32(validity)
+	}
+	return state
+}
+
+// resetState deletes every account's UID file and Message-ID cache from
+// the state directory, returning how many files were removed
+func resetState() (int, error) {
+	var files []string
+	for _, name := range []string{uidFile, seenIDsFile} {
+		matches, _ := filepath.Glob(filepath.Join(stateDir(), strings.TrimSuffix(name, ".txt")+"*.txt"))
+		files = append(files, matches...)
+	}
+
+	removed := 0
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// seenIDs is a ring buffer of recently notified Message-IDs, persisted so
+// duplicates are caught even after the UID state resets. It's shared by the
+// watchers of an account's mailboxes, mu guards it
+type seenIDs struct {
+	mu  sync.Mutex
+	ids []string
+	set map[string]bool
+
+	// started is set once the cache was loaded from its file or set up with
+	// start, so an empty cache can be told from a missing one
+	started bool
+}
+
+var (
+	seenByUser = map[string]*seenIDs{}
+	seenMu     sync.Mutex
+)
+
+// seenIDsPath returns the Message-ID cache file for the given account
+func seenIDsPath(user string) string {
+	return filepath.Join(stateDir(), strings.TrimSuffix(seenIDsFile, ".txt")+"_"+user+".txt")
+}
+
+// seenFor returns the account's Message-ID cache, loading it on first use
+func seenFor(user string) *seenIDs {
+	seenMu.Lock()
+	defer seenMu.Unlock()
+
+	if s, ok := seenByUser[user]; ok {
+		return s
+	}
+
+	s := &seenIDs{set: map[string]bool{}}
+	if f, err := os.Open(seenIDsPath(user)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			s.add(scanner.Text())
+		}
+		f.Close()
+		s.started = true
+	}
+	seenByUser[user] = s
+	return s
+}
+
+func (s *seenIDs) has(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.set[id]
+}
+
+// initialized reports whether the cache was saved before or set up with
+// start, even if it holds no IDs
+func (s *seenIDs) initialized() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+// start marks the cache as set up, see initialized
+func (s *seenIDs) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+}
+
+// add remembers id, forgetting the oldest one past maxSeenIDs
+func (s *seenIDs) add(id string) {
+	s.claim(id)
+}
+
+// claim remembers id and reports whether it was new, checking and adding in
+// one step so concurrent watchers can't both claim it. Empty IDs can't be
+// told apart and are always new
+func (s *seenIDs) claim(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == "" {
+		return true
+	}
+	if s.set[id] {
+		return false
+	}
+	s.ids = append(s.ids, id)
+	s.set[id] = true
+	if len(s.ids) > maxSeenIDs {
+		delete(s.set, s.ids[0])
+		s.ids = s.ids[1:]
+	}
+	return true
+}
+
+func (s *seenIDs) save(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeFileAtomic(seenIDsPath(user), []byte(strings.Join(s.ids, "\n")+"\n"))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// barStatus is the -status -json line, in the format waybar's custom module
+// reads with "return-type": "json"
+type barStatus struct {
+	Text    string `json:"text"`
+	Tooltip string `json:"tooltip"`
+	Class   string `json:"class"`
+}
+
+// unreadCount searches the watched mailbox for unread messages, selected
+// read-only. It doesn't retry, the bar runs it again soon anyway
+func unreadCount(acc account) (int, error) {
+	c, err := connect(acc)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Logout()
+
+	if _, err := c.Select(acc.mailbox, true); err != nil {
+		return 0, err
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	seqNums, err := search(c, criteria, false)
+	if err != nil {
+		return 0, err
+	}
+	return len(seqNums), nil
+}
+
+// printStatus prints the total unread count of all accounts as one line for
+// status bars like i3blocks, or as waybar JSON with -json. Failed accounts
+// show as "?" so a broken setup is visible in the bar
+func printStatus() {
+	total, failed := 0, false
+	var tooltip []string
+	for _, acc := range accounts {
+		name := acc.user
+		if multiMailbox() {
+			name += " " + acc.mailbox
+		}
+		n, err := unreadCount(acc)
+		if err != nil {
+			slog.Error("unread count failed", "account", acc.user, "mailbox", acc.mailbox, "err", err)
+			failed = true
+			tooltip = append(tooltip, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		total += n
+		tooltip = append(tooltip, fmt.Sprintf("%s: %d unread", name, n))
+	}
+
+	text := strconv.Itoa(total)
+	class := "read"
+	switch {
+	case failed:
+		text, class = "?", "error"
+	case total > 0:
+		class = "unread"
+	}
+
+	if !jsonOutput {
+		fmt.Println(text)
+		return
+	}
+	line, _ := json.Marshal(barStatus{Text: text, Tooltip: strings.Join(tooltip, "\n"), Class: class})
+	fmt.Println(string(line))
+}
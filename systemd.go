@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	sd "github.com/coreos/go-systemd/v22/daemon"
+)
+
+var readyOnce sync.Once
+
+// idleCheckInterval is how often an IDLE connection with nothing happening
+// stops to check the mailbox, so a connection that hung is noticed and the
+// watchdog and the last poll time stay current
+const idleCheckInterval = 2 * time.Minute
+
+// aliveByKey is when each mailbox watcher, by account.key, last checked in
+var (
+	aliveByKey = map[string]time.Time{}
+	aliveMu    sync.Mutex
+)
+
+// checkIn records that a mailbox watcher is still running, whether or not
+// its last check succeeded
+func checkIn(key string) {
+	aliveMu.Lock()
+	defer aliveMu.Unlock()
+	aliveByKey[key] = time.Now()
+}
+
+// watchersAlive reports whether every watcher checked in within window
+func watchersAlive(window time.Duration) bool {
+	aliveMu.Lock()
+	defer aliveMu.Unlock()
+	for _, acc := range accounts {
+		if time.Since(aliveByKey[acc.key]) > window {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyReady tells systemd the service is up after the first successful
+// mailbox check, for Type=notify units. It does nothing outside systemd
+func notifyReady() {
+	readyOnce.Do(func() {
+		if ok, err := sd.SdNotify(false, sd.SdNotifyReady); err != nil {
+			slog.Warn("sd_notify failed", "err", err)
+		} else if ok {
+			slog.Debug("notified systemd of readiness")
+		}
+	})
+}
+
+// runWatchdog pings systemd at half the unit's WatchdogSec until shutdown,
+// if the watchdog is enabled. A watcher that stops checking in stops the
+// pings, so systemd restarts the service
+func runWatchdog() {
+	interval, err := sd.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Watchers may wait up to an interval, an IDLE check or a reconnect
+			// backoff between check-ins, plus a command timeout
+			window := max(interval, currentRules().interval, idleCheckInterval, maxBackoff) + timeout
+			if !watchersAlive(window) {
+				slog.Warn("a watcher stopped checking in, not pinging the watchdog", "window", window)
+				continue
+			}
+			sd.SdNotify(false, sd.SdNotifyWatchdog)
+		case <-shutdown:
+			sd.SdNotify(false, sd.SdNotifyStopping)
+			return
+		}
+	}
+}
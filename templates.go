@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"text/template"
+)
+
+// templateData are the fields -summary-template and -body-template can use
+type templateData struct {
+	From    string
+	Subject string
+	Date    string
+	Body    string
+	Account string
+}
+
+// Parsed -summary-template and -body-template, nil to use the built-in format
+var summaryTmpl, bodyTmpl *template.Template
+
+// parseTemplates compiles the notification templates and tries them on a
+// sample message, so a typo like {{.Form}} is caught at startup. A broken
+// template is reported and the built-in format is kept
+func parseTemplates() {
+	summaryTmpl = parseTemplate("summary-template", summaryTemplate)
+	bodyTmpl = parseTemplate("body-template", bodyTemplate)
+}
+
+func parseTemplate(name, text string) *template.Template {
+	if text == "" {
+		return nil
+	}
+	t, err := template.New(name).Parse(text)
+	if err == nil {
+		err = t.Execute(&strings.Builder{}, templateData{})
+	}
+	if err != nil {
+		slog.Warn("invalid template, using the default format", "flag", name, "err", err)
+		return nil
+	}
+	return t
+}
+
+// renderTemplate fills t with a message, reporting false if it fails
+func renderTemplate(t *template.Template, user string, m newMail) (string, bool) {
+	var b strings.Builder
+	err := t.Execute(&b, templateData{
+		From:    m.sender,
+		Subject: m.subject,
+		Date:    m.date.Format("2006-01-02 15:04"),
+		Body:    m.body,
+		Account: user,
+	})
+	if err != nil {
+		slog.Error("rendering template failed", "template", t.Name(), "err", err)
+		return "", false
+	}
+	return b.String(), true
+}
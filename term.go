@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/term"
+)
+
+// autoLengthLines is how many terminal lines -length auto fills
+const autoLengthLines = 3
+
+// lengthAuto is set by -length auto, see autoLength
+var lengthAuto bool
+
+// lengthValue is the -length flag, a character count or "auto"
+type lengthValue struct{}
+
+func (lengthValue) String() string {
+	if lengthAuto {
+		return "auto"
+	}
+	return strconv.Itoa(msgLenght)
+}
+
+func (lengthValue) Set(s string) error {
+	if s == "auto" {
+		lengthAuto = true
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	msgLenght, lengthAuto = n, false
+	return nil
+}
+
+// autoLength returns a body length that fills autoLengthLines lines of the
+// terminal on stdout, or def when stdout isn't a terminal
+func autoLength(def int) int {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		return def
+	}
+	return max(width*autoLengthLines, minLength)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookTimeout bounds a webhook POST when -timeout is 0
+const webhookTimeout = 30 * time.Second
+
+// discordMaxContent is the length limit of a Discord message
+const discordMaxContent = 2000
+
+// slackEscaper escapes the characters Slack treats as markup in message text
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// mailEvent converts a new message to the -read -json shape, for webhooks and -socket
+func mailEvent(user string, m newMail) email {
+	e := email{
+		From:    m.sender,
+		Date:    m.date.Format(time.RFC3339),
+		Subject: m.subject,
+		Body:    m.body,
+		UID:     m.uid,
+	}
+	if multiAccount() {
+		e.Account = user
+	}
+	return e
+}
+
+// withWebhooks adds the -webhook, -slack-webhook and -discord-webhook
+// receivers to n, so they get what desktop notifications get: quiet hours,
+// -notify-when, -coalesce, -digest and -max-per-minute apply to both.
+// Each posts from its own queue with retries, off the watcher goroutine
+func withWebhooks(n Notifier) Notifier {
+	multi := multiNotifier{n}
+	client := &http.Client{Timeout: cmp.Or(timeout, webhookTimeout)}
+	for _, h := range []webhookNotifier{
+		{kind: "webhook", url: webhookURL, payload: webhookPayload},
+		{kind: "slack", url: slackWebhook, payload: slackPayload},
+		{kind: "discord", url: discordWebhook, payload: discordPayload},
+	} {
+		if h.url == "" {
+			continue
+		}
+		h.client = client
+		multi = append(multi, queuedNotifier{retryNotifier{h}, newWorker(h.kind)})
+	}
+	if len(multi) == 1 {
+		return n
+	}
+	return multi
+}
+
+// webhookNotifier POSTs notifications as JSON, shaped by payload
+type webhookNotifier struct {
+	kind    string
+	url     string
+	client  *http.Client
+	payload func(n notification) any
+}
+
+func (h webhookNotifier) Send(n notification) error {
+	if err := postJSON(h.client, h.url, h.payload(n)); err != nil {
+		return fmt.Errorf("%s: %w", h.kind, err)
+	}
+	slog.Debug("webhook sent", "kind", h.kind, "title", n.title)
+	return nil
+}
+
+// queuedNotifier sends on w, so Send only queues and never fails
+type queuedNotifier struct {
+	Notifier
+	w *worker
+}
+
+func (q queuedNotifier) Send(n notification) error {
+	q.w.run(func() {
+		if err := q.Notifier.Send(n); err != nil {
+			slog.Error("webhook failed", "err", err)
+		}
+	})
+	return nil
+}
+
+// webhookPayload is a new email in the -read -json shape. Summaries, digests
+// and notices have no single email and are posted as title, subject and body
+func webhookPayload(n notification) any {
+	if n.event != nil {
+		return n.event
+	}
+	return map[string]string{"title": n.title, "subject": n.subject, "body": n.body}
+}
+
+func slackPayload(n notification) any {
+	var text string
+	if e := n.event; e != nil {
+		text = fmt.Sprintf("*%s*\nFrom: %s%s",
+			slackEscaper.Replace(e.Subject), slackEscaper.Replace(e.From), accountLabel(e.Account))
+		if e.Body != "" {
+			text += "\n>>> " + slackEscaper.Replace(e.Body)
+		}
+	} else {
+		text = fmt.Sprintf("*%s*\n%s", slackEscaper.Replace(n.title), slackEscaper.Replace(n.subject))
+		if n.body != "" {
+			text += "\n>>> " + slackEscaper.Replace(n.body)
+		}
+	}
+	return map[string]string{"text": text}
+}
+
+func discordPayload(n notification) any {
+	var content string
+	if e := n.event; e != nil {
+		content = fmt.Sprintf("**%s**\nFrom: %s%s", e.Subject, e.From, accountLabel(e.Account))
+		if e.Body != "" {
+			content += "\n>>> " + e.Body
+		}
+	} else {
+		content = fmt.Sprintf("**%s**\n%s", n.title, n.subject)
+		if n.body != "" {
+			content += "\n>>> " + n.body
+		}
+	}
+	return map[string]string{"content": truncateBody(content, discordMaxContent)}
+}
+
+func postJSON(client *http.Client, url string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// workerQueue is how many jobs a worker holds before dropping new ones
+const workerQueue = 100
+
+// worker runs jobs in order on its own goroutine, so a slow receiver doesn't
+// hold up the watcher that queued them
+type worker struct {
+	name   string
+	mu     sync.Mutex
+	jobs   chan func()
+	done   chan struct{}
+	closed bool
+}
+
+var (
+	workers   []*worker
+	workersMu sync.Mutex
+)
+
+func newWorker(name string) *worker {
+	w := &worker{name: name, jobs: make(chan func(), workerQueue), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for job := range w.jobs {
+			job()
+		}
+	}()
+
+	workersMu.Lock()
+	workers = append(workers, w)
+	workersMu.Unlock()
+	return w
+}
+
+// run queues job, dropping it when the queue is full or the worker stopped
+func (w *worker) run(job func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.jobs <- job:
+	default:
+		slog.Warn("queue full, dropping", "worker", w.name)
+	}
+}
+
+// stopWorkers lets queued jobs finish before exiting, waiting up to timeout
+func stopWorkers(timeout time.Duration) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for _, w := range workers {
+		w.mu.Lock()
+		if !w.closed {
+			w.closed = true
+			close(w.jobs)
+		}
+		w.mu.Unlock()
+	}
+
+	deadline := time.After(timeout)
+	for _, w := range workers {
+		select {
+		case <-w.done:
+		case <-deadline:
+			slog.Warn("timed out waiting for queued jobs", "worker", w.name)
+			return
+		}
+	}
+}